@@ -0,0 +1,170 @@
+package mandala
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/smtp"
+)
+
+// TokenSource supplies the OAuth2 access tokens. It is called for every
+// authentication, so it must return a fresh token when the previous one has
+// expired: in this way the sessions opened by a long-lived SessionPool keep
+// working.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// TokenSourceFunc adapts a function to the TokenSource interface.
+type TokenSourceFunc func() (string, error)
+
+// Token returns f().
+func (f TokenSourceFunc) Token() (string, error) {
+	return f()
+}
+
+// OAuthError is the error sent by the server when the OAuth2 authentication
+// fails (RFC 7628 section 3.2.2). Session.Auth returns it wrapped together
+// with the SMTPError of the final reply.
+type OAuthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+}
+
+func (e *OAuthError) Error() string {
+	return fmt.Sprintf("smtp: OAuth2 authentication failed with status %s", e.Status)
+}
+
+// failedAuth is implemented by the mechanisms that receive the reason of a
+// failure before the final reply of the server: Session.Auth adds it to the
+// error of the reply.
+type failedAuth interface {
+	failure() error
+}
+
+// oauthFailure keeps the JSON error challenge sent by the server.
+type oauthFailure struct {
+	err *OAuthError
+}
+
+// next answers the error challenge of the server with the dummy response of
+// the mechanism, after which the server fails the authentication.
+func (f *oauthFailure) next(fromServer []byte, more bool, dummy []byte) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("smtp: unexpected OAuth2 challenge %q after the error", fromServer)
+	}
+	oerr := new(OAuthError)
+	if err := json.Unmarshal(fromServer, oerr); err != nil {
+		return nil, fmt.Errorf("smtp: unexpected OAuth2 challenge %q", fromServer)
+	}
+	f.err = oerr
+	return dummy, nil
+}
+
+func (f *oauthFailure) failure() error {
+	if f.err == nil {
+		return nil
+	}
+	return f.err
+}
+
+// errUnencrypted is returned when the credentials would be sent in plaintext.
+var errUnencrypted = errors.New("smtp: unencrypted connection")
+
+// isLocalhost reports whether the server is on the local host, where the
+// credentials can be sent without TLS.
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+type xoauth2Auth struct {
+	username string
+	tokens   TokenSource
+	oauthFailure
+}
+
+// XOAuth2Auth returns an Auth that implements the XOAUTH2 authentication
+// mechanism used by Gmail and Microsoft 365. The token is requested to ts
+// for every authentication.
+// XOAuth2Auth will only send the credentials if the connection is using TLS
+// or is connected to localhost.
+func XOAuth2Auth(username string, ts TokenSource) smtp.Auth {
+	return &xoauth2Auth{username: username, tokens: ts}
+}
+
+func (a *xoauth2Auth) newAuth() smtp.Auth {
+	return &xoauth2Auth{username: a.username, tokens: a.tokens}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errUnencrypted
+	}
+	token, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	resp := []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01")
+	return "XOAUTH2", resp, nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// XOAUTH2 expects an empty response to the error challenge
+	return a.next(fromServer, more, []byte{})
+}
+
+type oauthBearerAuth struct {
+	username string
+	tokens   TokenSource
+	oauthFailure
+}
+
+// OAuthBearerAuth returns an Auth that implements the OAUTHBEARER
+// authentication mechanism (RFC 7628). The token is requested to ts for
+// every authentication.
+// OAuthBearerAuth will only send the credentials if the connection is using
+// TLS or is connected to localhost.
+func OAuthBearerAuth(username string, ts TokenSource) smtp.Auth {
+	return &oauthBearerAuth{username: username, tokens: ts}
+}
+
+func (a *oauthBearerAuth) newAuth() smtp.Auth {
+	return &oauthBearerAuth{username: a.username, tokens: a.tokens}
+}
+
+func (a *oauthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errUnencrypted
+	}
+	token, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	resp := []byte("n,a=" + saslName(a.username) + ",\x01host=" + server.Name + "\x01auth=Bearer " + token + "\x01\x01")
+	return "OAUTHBEARER", resp, nil
+}
+
+func (a *oauthBearerAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// the dummy response of RFC 7628 section 3.2.3
+	return a.next(fromServer, more, []byte{0x01})
+}
+
+// saslName encodes the characters "," and "=" of an authorization identity (RFC 5801).
+func saslName(name string) string {
+	var out []byte
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case ',':
+			out = append(out, "=2C"...)
+		case '=':
+			out = append(out, "=3D"...)
+		default:
+			out = append(out, name[i])
+		}
+	}
+	return string(out)
+}
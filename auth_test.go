@@ -0,0 +1,82 @@
+package mandala
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestOAuth2Auth(t *testing.T) {
+	n := 0
+	ts := TokenSourceFunc(func() (string, error) {
+		n++
+		return "token" + string(rune('0'+n)), nil
+	})
+	tests := []struct {
+		name     string
+		auth     smtp.Auth
+		server   *smtp.ServerInfo
+		wantMech string
+		wantResp string
+		wantErr  bool
+	}{
+		{name: "XOAUTH2", auth: XOAuth2Auth("user@test.com", ts), server: &smtp.ServerInfo{Name: "smtp.test.com", TLS: true},
+			wantMech: "XOAUTH2", wantResp: "user=user@test.com\x01auth=Bearer token1\x01\x01"},
+		{name: "OAUTHBEARER", auth: OAuthBearerAuth("user,x@test.com", ts), server: &smtp.ServerInfo{Name: "smtp.test.com", TLS: true},
+			wantMech: "OAUTHBEARER", wantResp: "n,a=user=2Cx@test.com,\x01host=smtp.test.com\x01auth=Bearer token2\x01\x01"},
+		{name: "unencrypted", auth: XOAuth2Auth("user@test.com", ts), server: &smtp.ServerInfo{Name: "smtp.test.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mech, resp, err := tt.auth.Start(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Auth.Start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mech != tt.wantMech || string(resp) != tt.wantResp {
+				t.Errorf("Auth.Start() = %q, %q, want %q, %q", mech, resp, tt.wantMech, tt.wantResp)
+			}
+		})
+	}
+}
+
+func TestSession_Auth_OAuthError(t *testing.T) {
+	challenge := base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`))
+	ts := TokenSourceFunc(func() (string, error) { return "expired", nil })
+	tests := []struct {
+		name     string
+		mech     string
+		auth     smtp.Auth
+		wantResp string // base64 response to the error challenge
+	}{
+		{name: "XOAUTH2", mech: "XOAUTH2", auth: XOAuth2Auth("user@test.com", ts), wantResp: ""},
+		{name: "OAUTHBEARER", mech: "OAUTHBEARER", auth: OAuthBearerAuth("user@test.com", ts), wantResp: "AQ=="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cmds := newFakeSession(t, "220 hello", "250-localhost", "250 AUTH "+tt.mech, "334 "+challenge,
+				"535 5.7.8 Username and Password not accepted", "501 aborted", "221 bye")
+			c.serverName = "localhost"
+			c.a = tt.auth
+			err := c.Auth()
+			var oerr *OAuthError
+			if !errors.As(err, &oerr) || oerr.Status != "401" || oerr.Scope != "https://mail.google.com/" {
+				t.Errorf("Session.Auth() error = %v, want *OAuthError", err)
+			}
+			var serr *SMTPError
+			if !errors.As(err, &serr) || serr.Code != 535 {
+				t.Errorf("Session.Auth() error = %v, want *SMTPError 535", err)
+			}
+			// the error challenge is answered with the dummy response
+			lines := strings.Split(cmds.String(), "\r\n")
+			i := 0
+			for i < len(lines) && !strings.HasPrefix(lines[i], "AUTH "+tt.mech+" ") {
+				i++
+			}
+			if i+1 >= len(lines) || lines[i+1] != tt.wantResp {
+				t.Errorf("Session.Auth() sent %q, want the response %q after AUTH", cmds.String(), tt.wantResp)
+			}
+		})
+	}
+}
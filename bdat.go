@@ -0,0 +1,122 @@
+package mandala
+
+import (
+	"fmt"
+	"io"
+	"net/textproto"
+	"time"
+)
+
+// DefaultChunkSize is the size of the BDAT chunks used when Session.ChunkSize is 0.
+const DefaultChunkSize = 1 << 20
+
+// Bdat returns a writer that sends the message using BDAT commands (RFC 3030).
+// The message is split in chunks of Session.ChunkSize bytes and the last
+// chunk is sent when the writer is closed. A call to Bdat must be preceded
+// by one or more calls to Rcpt and only servers that advertise the CHUNKING
+// extension support this function.
+// Bare LF line endings are converted to CRLF unless binary is true.
+func (c *Session) Bdat(binary bool) io.WriteCloser {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	c.data = dataStarted
+	c.startTrace()
+	return &bdatWriter{c: c, size: size, buf: make([]byte, 0, size), binary: binary, start: time.Now()}
+}
+
+// chunking reports whether the message can be sent using BDAT.
+func (c *Session) chunking() bool {
+	ok, _ := c.Extension("CHUNKING")
+	return ok
+}
+
+// bdatWriter buffers the message and sends it in chunks.
+type bdatWriter struct {
+	c      *Session
+	size   int
+	buf    []byte
+	binary bool
+	cr     bool // whether the last byte written was a CR
+	err    error
+	start  time.Time // when the writer was created
+	n      int64     // bytes sent
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for _, b := range p {
+		if !w.binary && b == '\n' && !w.cr {
+			w.writeByte('\r')
+		}
+		w.writeByte(b)
+		w.cr = b == '\r'
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// writeByte appends a byte to the buffer sending a chunk when it is full.
+func (w *bdatWriter) writeByte(b byte) {
+	if len(w.buf) == w.size {
+		w.err = w.chunk(false)
+	}
+	w.buf = append(w.buf, b)
+}
+
+// Close sends the last chunk and reads the server reply.
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.chunk(true)
+	w.c.observe(PhaseEvent{Phase: PhaseData, Code: replyCode(w.err, 250), Bytes: w.n, Err: w.err}, w.start)
+	return w.err
+}
+
+// chunk sends a BDAT command with the buffered data.
+func (w *bdatWriter) chunk(last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+	text := w.c.Text
+	w.c.setDeadline(w.c.Timeouts.DataBlock)
+	id := text.Next()
+	text.StartRequest(id)
+	err := text.PrintfLine("%s", cmd)
+	if err == nil {
+		_, err = text.W.Write(w.buf)
+	}
+	if err == nil {
+		err = text.W.Flush()
+	}
+	text.EndRequest(id)
+	text.StartResponse(id)
+	if err != nil {
+		text.EndResponse(id)
+		return err
+	}
+	w.n += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	if last {
+		defer text.EndResponse(id)
+		w.c.data = dataEnded
+		w.c.setDeadline(w.c.Timeouts.DataTermination)
+		return w.c.readDataReply()
+	}
+	_, _, err = text.ReadResponse(250)
+	text.EndResponse(id)
+	if _, ok := err.(*textproto.Error); ok {
+		// the server failed the transaction (RFC 3030 section 2): it is
+		// reset, so the session can send the next message
+		w.c.data = dataNone
+		w.c.Reset()
+	}
+	return w.c.replyError("BDAT", err)
+}
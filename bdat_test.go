@@ -0,0 +1,108 @@
+package mandala
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/maxzerbini/mandala/mandalatest"
+)
+
+func TestSession_Bdat(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int
+		binary    bool
+		data      string
+		wantCmds  string
+	}{
+		{name: "single chunk", chunkSize: 0, data: "Hello\r\n", wantCmds: "BDAT 7 LAST\r\nHello\r\n"},
+		{name: "two chunks", chunkSize: 4, data: "Hello\r\n", wantCmds: "BDAT 4\r\nHellBDAT 3 LAST\r\no\r\n"},
+		{name: "bare LF", chunkSize: 0, data: "Hello\nworld", wantCmds: "BDAT 12 LAST\r\nHello\r\nworld"},
+		{name: "binary", chunkSize: 0, binary: true, data: "Hello\nworld", wantCmds: "BDAT 11 LAST\r\nHello\nworld"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cmds := newFakeSession(t, "220 hello", "250 ok", "250 ok")
+			c.ChunkSize = tt.chunkSize
+			w := c.Bdat(tt.binary)
+			if _, err := w.Write([]byte(tt.data)); err != nil {
+				t.Errorf("bdatWriter.Write() error = %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("bdatWriter.Close() error = %v", err)
+			}
+			if got := cmds.String(); got != tt.wantCmds {
+				t.Errorf("Session.Bdat() sent %q, want %q", got, tt.wantCmds)
+			}
+		})
+	}
+}
+
+func TestSession_SendSingleMessage_BinaryMIME(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   []string
+		snippets []string
+		wantNot  string
+	}{
+		{name: "binary", server: []string{"220 hello", "250-fake.host", "250-CHUNKING", "250 BINARYMIME", "250 ok", "250 ok", "250 queued"},
+			snippets: []string{"MAIL FROM:<from@test.com> BODY=BINARYMIME\r\n", "BDAT ", "Content-Transfer-Encoding: binary", "\x00\x01\n\x02"}},
+		{name: "downgrade to base64", server: []string{"220 hello", "250-fake.host", "250 8BITMIME", "250 ok", "250 ok", "354 go", "250 queued"},
+			snippets: []string{"MAIL FROM:<from@test.com> BODY=8BITMIME\r\n", "DATA\r\n", "Content-Transfer-Encoding: base64", "AAEKAg=="}, wantNot: "BDAT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+			msg.AddAttachment("data.bin", "application/octet-stream", []byte{0, 1, '\n', 2})
+			msg.Attachments[0].Encoding = "binary"
+			c, cmds := newFakeSession(t, tt.server...)
+			if err := c.SendSingleMessage(msg); err != nil {
+				t.Errorf("Session.SendSingleMessage() error = %v", err)
+			}
+			FindSnippets(t, cmds.String(), tt.snippets)
+			if tt.wantNot != "" && strings.Contains(cmds.String(), tt.wantNot) {
+				t.Errorf("Session.SendSingleMessage() sent %q", tt.wantNot)
+			}
+			if msg.Attachments[0].Encoding != "binary" {
+				t.Errorf("Session.SendSingleMessage() changed the encoding of the attachment to %q", msg.Attachments[0].Encoding)
+			}
+		})
+	}
+}
+
+func TestSession_SendSingleMessage_ChunkRejected(t *testing.T) {
+	s := mandalatest.NewServer("CHUNKING", "PIPELINING")
+	defer s.Close()
+	s.Script("BDAT", "552 5.3.4 too big")
+	c, err := NewSession(s.Addr, nil)
+	if err != nil {
+		t.Fatalf("NewSession() error = %v", err)
+	}
+	defer c.Close()
+	c.ChunkSize = 16
+	if err := c.StartSession(); err != nil {
+		t.Fatalf("Session.StartSession() error = %v", err)
+	}
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	var serr *SMTPError
+	if err := c.SendSingleMessage(msg); !errors.As(err, &serr) || serr.Code != 552 {
+		t.Fatalf("Session.SendSingleMessage() error = %v, want 552", err)
+	}
+	if c.data != dataNone {
+		t.Errorf("Session.SendSingleMessage() left data state %d, want %d", c.data, dataNone)
+	}
+	// the next message is sent in a new transaction
+	msg = NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Again", "", "Hello again!")
+	if err := c.SendSingleMessage(msg); err != nil {
+		t.Fatalf("Session.SendSingleMessage() second message error = %v", err)
+	}
+	messages := s.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Server.Messages() = %d messages, want 1", len(messages))
+	}
+	if data := string(messages[0].Data); strings.Contains(data, "Subject: Hello\r\n") {
+		t.Errorf("Server.Messages()[0] contains the rejected chunk: %q", data)
+	}
+	FindSnippets(t, strings.Join(s.Commands(), "\n"), []string{"RSET"})
+}
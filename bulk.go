@@ -0,0 +1,265 @@
+package mandala
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// reconnect replaces the connection of the session with a new one opened by
+// the dialer of the session and starts a new session. The settings of the
+// session are kept.
+func (c *Session) reconnect() error {
+	c.Text.Close()
+	ctx := context.Background()
+	c.mu.Lock()
+	if c.ctx != nil {
+		// the running operation has a context
+		ctx = c.ctx
+	}
+	c.mu.Unlock()
+	start := time.Now()
+	conn, err := c.dialer.dial(ctx)
+	if err != nil {
+		return err
+	}
+	c.setConn(conn)
+	c.ext, c.auth = nil, nil
+	c.didHello, c.helloError = false, nil
+	c.messages = 0
+	c.setDeadline(c.Timeouts.Greeting)
+	if err := c.greeting(start); err != nil {
+		c.Text.Close()
+		return err
+	}
+	return c.StartSession()
+}
+
+// sendBulk sends a message of a bulk. It reconnects if the session is broken
+// and sends the message again if the connection was lost before the end of
+// the message was sent, and it reconnects before sending if
+// MaxMessagesPerConnection messages have been sent. A session still broken
+// after sending is closed, so the next message reconnects. It returns the
+// outcome of the message and the error of the reconnection, if it failed.
+func (c *Session) sendBulk(msg *Email) (SendBulkReportItem, error) {
+	if c.MaxMessagesPerConnection > 0 && c.messages >= c.MaxMessagesPerConnection && c.dialer != nil {
+		c.Quit()
+		if err := c.reconnect(); err != nil {
+			return SendBulkReportItem{MessageID: msg.MessageID, Err: err}, err
+		}
+	}
+	results, err := c.SendSingleMessageResults(msg)
+	if isBroken(c, err) && c.dialer != nil {
+		resend := !c.uncertain(err)
+		if rerr := c.reconnect(); rerr != nil {
+			return SendBulkReportItem{MessageID: msg.MessageID, Err: err, Recipients: results}, rerr
+		}
+		if !resend {
+			return SendBulkReportItem{MessageID: msg.MessageID, Err: err, Recipients: results}, nil
+		}
+		results, err = c.SendSingleMessageResults(msg)
+	}
+	if isBroken(c, err) {
+		// the next command would be sent in the middle of the message
+		c.Text.Close()
+	}
+	return SendBulkReportItem{MessageID: msg.MessageID, Sent: err == nil, Err: err, Recipients: results}, nil
+}
+
+// BulkSender sends messages in parallel across many connections to the same server.
+// A BulkSender is safe for concurrent use by multiple goroutines.
+type BulkSender struct {
+	// Dialer opens the sessions, that are started with StartSession.
+	Dialer *SessionDialer
+	// Concurrency is the number of concurrent connections, the default is 1.
+	Concurrency int
+	// Rate is the maximum number of messages per second sent over every
+	// connection, 0 means unlimited.
+	Rate float64
+	// MaxMessagesPerConnection is the number of messages sent using the same
+	// connection before it is replaced, 0 means unlimited. The messages
+	// rejected or failed are not counted.
+	MaxMessagesPerConnection int
+	// Observer receives the events of all the sessions, it must be safe for concurrent use.
+	Observer Observer
+	// Limiter throttles the messages per recipient domain, if nil they are
+	// not throttled. A message waits for the limits of all its domains.
+	Limiter *RateLimiter
+}
+
+// NewBulkSender returns a new BulkSender using concurrency connections opened by the dialer.
+func NewBulkSender(d *SessionDialer, concurrency int) *BulkSender {
+	return &BulkSender{Dialer: d, Concurrency: concurrency}
+}
+
+// Send sends the messages and returns their outcome in input order.
+// When the context is done the messages not sent are reported with the context error.
+// The MessageID of the messages is generated when empty, so the messages
+// must not be modified until Send returns.
+func (b *BulkSender) Send(ctx context.Context, messages []*Email) SendBulkReport {
+	report := make(SendBulkReport, len(messages))
+	sent := make([]bool, len(messages))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < b.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &bulkWorker{b: b}
+			defer w.close()
+			for i := range jobs {
+				report[i] = w.send(ctx, messages[i])
+				sent[i] = true
+			}
+		}()
+	}
+feed:
+	for i := range messages {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	for i, msg := range messages {
+		if !sent[i] {
+			report[i] = SendBulkReportItem{MessageID: msg.MessageID, Err: ctx.Err()}
+		}
+	}
+	return report
+}
+
+// SendChan sends the messages received from the channel until it is closed or
+// the context is done. The outcome of every message is sent on the returned
+// channel, that is closed when all the sendings are over and must be drained.
+// The items can be matched to the messages by MessageID, that is generated
+// when empty: the messages must not be modified until their item is received.
+func (b *BulkSender) SendChan(ctx context.Context, messages <-chan *Email) <-chan SendBulkReportItem {
+	out := make(chan SendBulkReportItem)
+	var wg sync.WaitGroup
+	for i := 0; i < b.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &bulkWorker{b: b}
+			defer w.close()
+			for {
+				select {
+				case msg, ok := <-messages:
+					if !ok {
+						return
+					}
+					out <- w.send(ctx, msg)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func (b *BulkSender) concurrency() int {
+	if b.Concurrency <= 0 {
+		return 1
+	}
+	return b.Concurrency
+}
+
+// bulkWorker sends messages over its own connection, opened on the first
+// message and opened again after a failed reconnection.
+type bulkWorker struct {
+	b    *BulkSender
+	c    *Session
+	next time.Time // earliest time of the next sending
+}
+
+// send sends a message respecting the rate of the connection.
+// It sets the MessageID of the message, if empty, to report it.
+func (w *bulkWorker) send(ctx context.Context, msg *Email) SendBulkReportItem {
+	msg.setMessageID()
+	if err := w.wait(ctx); err != nil {
+		return SendBulkReportItem{MessageID: msg.MessageID, Err: err}
+	}
+	if w.b.Limiter != nil {
+		done, err := w.b.Limiter.waitAll(ctx, msg.recipients())
+		if err != nil {
+			return SendBulkReportItem{MessageID: msg.MessageID, Err: err}
+		}
+		item := w.sendSession(ctx, msg)
+		done(item.Err)
+		return item
+	}
+	return w.sendSession(ctx, msg)
+}
+
+// sendSession sends a message using the session of the worker. The session
+// is closed when it is broken, the next message opens a new one.
+func (w *bulkWorker) sendSession(ctx context.Context, msg *Email) SendBulkReportItem {
+	if w.c == nil {
+		c, err := w.dial(ctx)
+		if err != nil {
+			return SendBulkReportItem{MessageID: msg.MessageID, Err: err}
+		}
+		w.c = c
+	}
+	var item SendBulkReportItem
+	var broken error
+	err := w.c.runContext(ctx, func() error {
+		item, broken = w.c.sendBulk(msg)
+		return item.Err
+	})
+	item.Err, item.Sent = err, err == nil
+	if broken != nil || ctx.Err() != nil || isBroken(w.c, err) {
+		w.c.Close()
+		w.c = nil
+	}
+	return item
+}
+
+// dial opens and starts a new session.
+func (w *bulkWorker) dial(ctx context.Context) (*Session, error) {
+	c, err := w.b.Dialer.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.MaxMessagesPerConnection = w.b.MaxMessagesPerConnection
+	c.Observer = w.b.Observer
+	if err := c.StartSessionContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// wait waits until the next message can be sent.
+func (w *bulkWorker) wait(ctx context.Context) error {
+	if w.b.Rate <= 0 {
+		return ctx.Err()
+	}
+	if d := time.Until(w.next); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	w.next = time.Now().Add(time.Duration(float64(time.Second) / w.b.Rate))
+	return ctx.Err()
+}
+
+// close quits the session of the worker.
+func (w *bulkWorker) close() {
+	if w.c != nil {
+		w.c.Quit()
+		w.c.Close()
+	}
+}
@@ -0,0 +1,328 @@
+package mandala
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptServer is a loopback SMTP server whose replies to MAIL FROM and to
+// the end of the message are decided by functions of the connection number
+// and of the message number.
+type scriptServer struct {
+	l     net.Listener
+	mu    sync.Mutex
+	conns int
+	msgs  int // messages received
+	mail  func(conn, msg int) string
+	data  func(conn, msg int) string // if nil the messages are accepted, an empty reply drops the connection
+}
+
+func newScriptServer(t *testing.T, mail func(conn, msg int) string) *scriptServer {
+	return newScriptServerData(t, mail, nil)
+}
+
+func newScriptServerData(t *testing.T, mail, data func(conn, msg int) string) *scriptServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	s := &scriptServer{l: l, mail: mail, data: data}
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *scriptServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		n := s.conns
+		s.mu.Unlock()
+		go s.handle(conn, n)
+	}
+}
+
+func (s *scriptServer) handle(conn net.Conn, n int) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 hello")
+	msg := 0
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "EHLO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			msg++
+			reply := s.mail(n, msg)
+			text.PrintfLine("%s", reply)
+			if strings.HasPrefix(reply, "421") {
+				return
+			}
+		case "DATA":
+			text.PrintfLine("354 go")
+			text.ReadDotLines()
+			s.mu.Lock()
+			s.msgs++
+			s.mu.Unlock()
+			reply := "250 queued"
+			if s.data != nil {
+				reply = s.data(n, msg)
+			}
+			if reply == "" {
+				return
+			}
+			text.PrintfLine("%s", reply)
+			if strings.HasPrefix(reply, "421") {
+				return
+			}
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+// failDialer dials TCP connections. If fail is not empty the writes of the
+// first connection, or of every connection, fail from the one containing fail on.
+type failDialer struct {
+	fail  string
+	every bool
+	conns int
+}
+
+func (d *failDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.conns++
+	if d.fail == "" || d.conns > 1 && !d.every {
+		return conn, nil
+	}
+	return &failConn{Conn: conn, fail: d.fail}, nil
+}
+
+type failConn struct {
+	net.Conn
+	fail   string
+	failed bool
+}
+
+func (c *failConn) Write(p []byte) (int, error) {
+	if c.failed || strings.Contains(string(p), c.fail) {
+		c.failed = true
+		return 0, errors.New("write failed")
+	}
+	return c.Conn.Write(p)
+}
+
+func TestSession_SendMessageBulk_Reconnect(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxMessages int
+		mail        func(conn, msg int) string
+		data        func(conn, msg int) string
+		fail        string // the writes of the first connection fail from it on
+		wantConns   int
+		wantSent    []bool
+		wantMsgs    int // messages received by the server, if not 0
+	}{
+		{name: "service not available", mail: func(conn, msg int) string {
+			if conn == 1 && msg == 2 {
+				return "421 closing"
+			}
+			return "250 ok"
+		}, wantConns: 2, wantSent: []bool{true, true, true}},
+		{name: "failed again after reconnecting", mail: func(conn, msg int) string {
+			if conn == 1 && msg == 2 || conn == 2 {
+				return "421 closing"
+			}
+			return "250 ok"
+		}, wantConns: 3, wantSent: []bool{true, false, true}},
+		{name: "connection lost after the message", mail: func(conn, msg int) string { return "250 ok" },
+			data: func(conn, msg int) string {
+				if conn == 1 && msg == 2 {
+					return ""
+				}
+				return "250 queued"
+			}, wantConns: 2, wantSent: []bool{true, false, true}, wantMsgs: 3},
+		{name: "service not available after the message", mail: func(conn, msg int) string { return "250 ok" },
+			data: func(conn, msg int) string {
+				if conn == 1 && msg == 2 {
+					return "421 closing"
+				}
+				return "250 queued"
+			}, wantConns: 2, wantSent: []bool{true, true, true}, wantMsgs: 4},
+		{name: "message interrupted", mail: func(conn, msg int) string { return "250 ok" }, fail: "Subject: message 1",
+			wantConns: 2, wantSent: []bool{true, true, true}},
+		{name: "max messages per connection", maxMessages: 2, mail: func(conn, msg int) string { return "250 ok" },
+			wantConns: 2, wantSent: []bool{true, true, true}},
+		{name: "rejected", mail: func(conn, msg int) string {
+			if msg == 2 {
+				return "550 rejected"
+			}
+			return "250 ok"
+		}, wantConns: 1, wantSent: []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScriptServerData(t, tt.mail, tt.data)
+			d := &SessionDialer{Address: s.l.Addr().String(), Dialer: &failDialer{fail: tt.fail}}
+			c, err := d.Dial()
+			if err != nil {
+				t.Fatalf("SessionDialer.Dial() error = %v", err)
+			}
+			c.MaxMessagesPerConnection = tt.maxMessages
+			messages := make([]*Email, 0, len(tt.wantSent))
+			for i := range tt.wantSent {
+				messages = append(messages, NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, fmt.Sprintf("message %d", i), "", "Hello world!"))
+			}
+			report, _ := c.SendMessageBulk(messages)
+			if len(report) != len(tt.wantSent) {
+				t.Fatalf("Session.SendMessageBulk() returned %d items, want %d", len(report), len(tt.wantSent))
+			}
+			for i, item := range report {
+				if item.Sent != tt.wantSent[i] {
+					t.Errorf("report[%d] = %+v, want sent %v", i, item, tt.wantSent[i])
+				}
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.conns != tt.wantConns {
+				t.Errorf("connections = %d, want %d", s.conns, tt.wantConns)
+			}
+			if tt.wantMsgs != 0 && s.msgs != tt.wantMsgs {
+				t.Errorf("messages received = %d, want %d", s.msgs, tt.wantMsgs)
+			}
+		})
+	}
+}
+
+func TestBulkSender_Send(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		rate        float64
+		limits      []DomainLimit
+		messages    int
+		canceled    bool
+		minDuration time.Duration
+	}{
+		{name: "sequential", concurrency: 1, messages: 3},
+		{name: "parallel", concurrency: 3, messages: 10},
+		{name: "rate limited", concurrency: 1, rate: 50, messages: 5, minDuration: 80 * time.Millisecond},
+		{name: "domain limited", concurrency: 3, limits: []DomainLimit{{Pattern: "test.com", PerSecond: 50}}, messages: 55,
+			minDuration: 80 * time.Millisecond},
+		{name: "canceled", concurrency: 2, messages: 3, canceled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScriptServer(t, func(conn, msg int) string { return "250 ok" })
+			b := NewBulkSender(&SessionDialer{Address: s.l.Addr().String()}, tt.concurrency)
+			b.Rate = tt.rate
+			if tt.limits != nil {
+				b.Limiter = NewRateLimiter(tt.limits...)
+			}
+			messages := make([]*Email, 0, tt.messages)
+			for i := 0; i < tt.messages; i++ {
+				msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+				msg.MessageID = fmt.Sprintf("%d@test.com", i)
+				messages = append(messages, msg)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.canceled {
+				cancel()
+			}
+			defer cancel()
+			start := time.Now()
+			report := b.Send(ctx, messages)
+			if elapsed := time.Since(start); elapsed < tt.minDuration {
+				t.Errorf("BulkSender.Send() took %v, want at least %v", elapsed, tt.minDuration)
+			}
+			if len(report) != tt.messages {
+				t.Fatalf("BulkSender.Send() returned %d items, want %d", len(report), tt.messages)
+			}
+			for i, item := range report {
+				if item.MessageID != messages[i].MessageID {
+					t.Errorf("report[%d].MessageID = %q, want %q", i, item.MessageID, messages[i].MessageID)
+				}
+				if tt.canceled && item.Err != context.Canceled {
+					t.Errorf("report[%d].Err = %v, want %v", i, item.Err, context.Canceled)
+				}
+				if !tt.canceled && !item.Sent {
+					t.Errorf("report[%d] = %+v, want sent", i, item)
+				}
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.conns > tt.concurrency {
+				t.Errorf("connections = %d, want at most %d", s.conns, tt.concurrency)
+			}
+		})
+	}
+}
+
+func TestBulkWorker_Send_Interrupted(t *testing.T) {
+	s := newScriptServer(t, func(conn, msg int) string { return "250 ok" })
+	d := &failDialer{fail: "Subject: interrupted", every: true}
+	w := &bulkWorker{b: NewBulkSender(&SessionDialer{Address: s.l.Addr().String(), Dialer: d}, 1)}
+	defer w.close()
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "interrupted", "", "Hello world!")
+	if item := w.send(context.Background(), msg); item.Sent {
+		t.Errorf("bulkWorker.send() = %+v, want not sent", item)
+	}
+	if w.c != nil {
+		t.Errorf("bulkWorker.send() kept the broken session")
+	}
+	msg = NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	if item := w.send(context.Background(), msg); !item.Sent {
+		t.Errorf("bulkWorker.send() = %+v, want sent", item)
+	}
+	// the message is interrupted twice, the next one uses a new session
+	if d.conns != 3 {
+		t.Errorf("connections = %d, want 3", d.conns)
+	}
+}
+
+func TestBulkSender_SendChan(t *testing.T) {
+	s := newScriptServer(t, func(conn, msg int) string { return "250 ok" })
+	b := NewBulkSender(&SessionDialer{Address: s.l.Addr().String()}, 2)
+	in := make(chan *Email)
+	ids := make(map[string]bool)
+	go func() {
+		for i := 0; i < 6; i++ {
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+			in <- msg
+		}
+		close(in)
+	}()
+	for item := range b.SendChan(context.Background(), in) {
+		if item.MessageID == "" || ids[item.MessageID] {
+			t.Errorf("BulkSender.SendChan() item MessageID = %q, want unique", item.MessageID)
+		}
+		ids[item.MessageID] = true
+		if !item.Sent {
+			t.Errorf("BulkSender.SendChan() item = %+v, want sent", item)
+		}
+	}
+	if len(ids) != 6 {
+		t.Errorf("BulkSender.SendChan() returned %d items, want 6", len(ids))
+	}
+}
@@ -6,6 +6,8 @@ package mandala
 */
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -14,20 +16,77 @@ import (
 	"net"
 	"net/smtp"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"golang.org/x/net/idna"
 )
 
+// TLSPolicy decides how a Session uses STARTTLS.
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic upgrades the connection when the server advertises STARTTLS
+	// and sends in plaintext otherwise.
+	TLSOpportunistic TLSPolicy = iota
+	// TLSMandatory fails before AUTH or MAIL when the connection can not be encrypted.
+	TLSMandatory
+	// TLSDisabled never upgrades the connection.
+	TLSDisabled
+)
+
+// ErrTLSNotAvailable is returned when the TLS policy is TLSMandatory and the connection is not encrypted.
+var ErrTLSNotAvailable = errors.New("smtp: TLS is required but the server does not support STARTTLS")
+
 // Session represents a client connection to an SMTP server.
 type Session struct {
+	// TLSPolicy decides how StartSession uses STARTTLS, the default is TLSOpportunistic.
+	TLSPolicy TLSPolicy
+	// TLSConfig is the optional TLS configuration used by StartSession.
+	// If ServerName is empty the server name of the session is used.
+	TLSConfig *tls.Config
+	// PartialDelivery allows to deliver a message to the accepted recipients
+	// when the server rejects some of them.
+	PartialDelivery bool
+	// Timeouts are the timeouts of the SMTP phases, the default is no timeout.
+	Timeouts Timeouts
+	// ChunkSize is the size of the chunks sent with BDAT when the server
+	// supports CHUNKING, if 0 DefaultChunkSize is used.
+	ChunkSize int
+	// Tracer receives the transcript of the session, the default is no transcript.
+	// The greeting is passed to the Tracer before the first line sent.
+	Tracer Tracer
+	// TraceBodyLimit is the number of bytes of every message body passed to
+	// the Tracer, the rest is elided. The default is to elide the whole body.
+	TraceBodyLimit int
+	// LMTP switches the session to LMTP (RFC 2033): LHLO is sent in place of
+	// EHLO and the server replies to the message once for every accepted
+	// recipient. It must be set before the first command.
+	LMTP bool
+	// MaxMessagesPerConnection is the number of messages SendMessageBulk sends
+	// using the same connection before it reconnects, 0 means unlimited.
+	// The messages rejected or failed are not counted.
+	MaxMessagesPerConnection int
+	// Observer receives the events of the phases of the session, the default is no events.
+	// The connection event is passed to the Observer before the first event of the session.
+	Observer Observer
 	// Text is the textproto.Conn used by the Client. It is exported to allow for
 	// clients to add extensions.
 	Text *textproto.Conn
 	// keep a reference to the connection so it can be used to create a TLS
 	// connection later
-	conn net.Conn
+	conn    net.Conn
+	trace   *transcript    // nil if the connection is not traced
+	greet   []string       // greeting lines, kept until the connection is traced
+	connect *PhaseEvent    // connection event not observed yet
+	dialer  *SessionDialer // dialer used to reconnect, nil if the session can not reconnect
+	// recipients accepted in the current transaction and their LMTP delivery outcome
+	accepted  []string
+	delivered []RcptResult
+	data      dataState // progress of the message data of the current transaction
 	// whether the Client is using TLS
 	tls        bool
 	serverName string
@@ -39,13 +98,38 @@ type Session struct {
 	didHello   bool   // whether we've said HELO/EHLO
 	helloError error  // the error from the hello
 	a          smtp.Auth
+	messages   int // number of messages sent using this session
+	mu         sync.Mutex
+	ctx        context.Context // context of the running operation
+	deadline   bool            // whether a deadline is set on the connection
+}
+
+// dataState is the progress of the message data of a transaction, used to
+// know whether the server may have accepted the message when a failure occurs.
+type dataState int
+
+const (
+	dataNone    dataState = iota // the server is not waiting for the message data
+	dataStarted                  // the server has accepted DATA or the first BDAT chunk is being sent
+	dataEnded                    // the end of the message data has been sent
+)
+
+// uncertain reports whether the server may have accepted the message after
+// the operation that failed with err: the end of the message has been sent
+// and the server did not reply to it. Sending the message again could
+// deliver it twice, while before the end of the message the server can not
+// accept it.
+func (c *Session) uncertain(err error) bool {
+	var terr *textproto.Error
+	return err != nil && c.data == dataEnded && !errors.As(err, &terr)
 }
 
 // SendBulkReportItem represents the outcome of a single sending.
 type SendBulkReportItem struct {
-	MessageID string
-	Sent      bool
-	Err       error
+	MessageID  string
+	Sent       bool
+	Err        error
+	Recipients []RcptResult // outcome of every RCPT TO command
 }
 
 // SendBulkReport contains the list of the report items.
@@ -53,32 +137,66 @@ type SendBulkReport []SendBulkReportItem
 
 // NewSession returns a new client Session connected to an SMTP server at host.
 // The host must include a port, as in "mail.example.com:smtp".
+// SessionDialer allows to choose the network, the dialer and the server name.
 func NewSession(host string, a smtp.Auth) (*Session, error) {
-	conn, err := net.Dial("tcp", host)
-	if err != nil {
-		return nil, err
-	}
-	soloHost, _, _ := net.SplitHostPort(host)
-	c, err := NewSessionUsingConnection(conn, soloHost, a)
-	if err != nil {
-		return nil, err
-	}
-	return c, nil
+	d := &SessionDialer{Address: host, Auth: a}
+	return d.Dial()
+}
+
+// NewSessionTLS returns a new client Session connected to an SMTP server at host
+// using implicit TLS (SMTPS), as in "mail.example.com:465".
+// If config is nil a default configuration is used; if config.ServerName is
+// empty the host name is used to verify the server certificate.
+func NewSessionTLS(host string, a smtp.Auth, config *tls.Config) (*Session, error) {
+	d := &SessionDialer{Address: host, Auth: a, ImplicitTLS: true, TLSConfig: config}
+	return d.Dial()
 }
 
 // NewSessionUsingConnection returns a new Session using an existing connection and host as a
 // server name to be used when authenticating.
+// If conn is a *tls.Conn the session is considered already encrypted.
 func NewSessionUsingConnection(conn net.Conn, host string, auth smtp.Auth) (*Session, error) {
-	text := textproto.NewConn(conn)
-	_, _, err := text.ReadResponse(220)
-	if err != nil {
-		text.Close()
+	c := newSession(conn, host, auth)
+	if err := c.greeting(time.Now()); err != nil {
+		c.Text.Close()
 		return nil, err
 	}
-	c := &Session{Text: text, conn: conn, serverName: host, localName: "localhost", a: auth}
 	return c, nil
 }
 
+// newSession returns a new Session using the connection, without reading the greeting.
+func newSession(conn net.Conn, host string, auth smtp.Auth) *Session {
+	c := &Session{serverName: host, localName: "localhost", a: auth}
+	c.setConn(conn)
+	return c
+}
+
+// setConn makes the session use the connection.
+// If conn is a *tls.Conn the session is considered already encrypted.
+func (c *Session) setConn(conn net.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	_, c.tls = conn.(*tls.Conn)
+	c.trace, c.greet = nil, nil
+	if c.Tracer != nil {
+		c.trace = &transcript{c: c}
+	}
+	c.Text = c.newText()
+}
+
+// greeting reads the greeting of the server and records the connection event.
+func (c *Session) greeting(start time.Time) error {
+	code, msg, err := c.Text.ReadResponse(220)
+	if c.trace == nil {
+		// kept for a Tracer set later
+		c.greet = replyLines(code, msg)
+	}
+	err = c.replyError("GREETING", err)
+	c.connect = &PhaseEvent{Phase: PhaseConnect, Server: c.serverName, Duration: time.Since(start), Code: replyCode(err, 220), Err: err}
+	return err
+}
+
 // Close closes the connection.
 func (c *Session) Close() error {
 	return c.Text.Close()
@@ -88,10 +206,13 @@ func (c *Session) Close() error {
 func (c *Session) hello() error {
 	if !c.didHello {
 		c.didHello = true
+		start := time.Now()
 		err := c.ehlo()
-		if err != nil {
-			c.helloError = c.helo()
+		if err != nil && !c.LMTP {
+			err = c.helo()
 		}
+		c.helloError = err
+		c.observe(PhaseEvent{Phase: PhaseHello, Code: replyCode(err, 250), Err: err}, start)
 	}
 	return c.helloError
 }
@@ -111,14 +232,17 @@ func (c *Session) Hello(localName string) error {
 
 // cmd is a convenience function that sends a command and returns the response
 func (c *Session) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	id, err := c.Text.Cmd(format, args...)
+	line := fmt.Sprintf(format, args...)
+	c.startTrace()
+	c.setDeadline(c.Timeouts.command(line))
+	id, err := c.Text.Cmd("%s", line)
 	if err != nil {
 		return 0, "", err
 	}
 	c.Text.StartResponse(id)
 	defer c.Text.EndResponse(id)
 	code, msg, err := c.Text.ReadResponse(expectCode)
-	return code, msg, err
+	return code, msg, c.replyError(commandName(line), err)
 }
 
 // helo sends the HELO greeting to the server. It should be used only when the
@@ -131,8 +255,13 @@ func (c *Session) helo() error {
 
 // ehlo sends the EHLO (extended hello) greeting to the server. It
 // should be the preferred greeting for servers that support it.
+// In LMTP mode it sends LHLO.
 func (c *Session) ehlo() error {
-	_, msg, err := c.cmd(250, "EHLO %s", c.localName)
+	verb := "EHLO"
+	if c.LMTP {
+		verb = "LHLO"
+	}
+	_, msg, err := c.cmd(250, "%s %s", verb, c.localName)
 	if err != nil {
 		return err
 	}
@@ -162,16 +291,36 @@ func (c *Session) StartTLS(config *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	_, _, err := c.cmd(220, "STARTTLS")
+	start := time.Now()
+	err := c.handshake(config)
+	c.observe(PhaseEvent{Phase: PhaseTLS, Code: replyCode(err, 220), Err: err}, start)
 	if err != nil {
 		return err
 	}
-	c.conn = tls.Client(c.conn, config)
-	c.Text = textproto.NewConn(c.conn)
+	c.Text = c.newText()
 	c.tls = true
 	return c.ehlo()
 }
 
+// handshake sends the STARTTLS command and runs the TLS handshake.
+func (c *Session) handshake(config *tls.Config) error {
+	_, _, err := c.cmd(220, "STARTTLS")
+	if err != nil {
+		return err
+	}
+	tc := tls.Client(c.conn, config)
+	c.mu.Lock()
+	c.conn = tc
+	c.mu.Unlock()
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	if c.trace != nil {
+		c.trace.handshake(tc.ConnectionState())
+	}
+	return nil
+}
+
 // TLSConnectionState returns the client's TLS connection state.
 // The return values are their zero values if StartTLS did
 // not succeed.
@@ -202,8 +351,22 @@ func (c *Session) Auth() error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	if err := c.checkTLS(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := c.authenticate(c.a)
+	c.observe(PhaseEvent{Phase: PhaseAuth, Code: replyCode(err, 235), Err: err}, start)
+	return err
+}
+
+// authenticate runs the AUTH exchange using the authentication mechanism.
+func (c *Session) authenticate(a smtp.Auth) error {
+	if sa, ok := a.(statefulAuth); ok {
+		a = sa.newAuth()
+	}
 	encoding := base64.StdEncoding
-	mech, resp, err := c.a.Start(&smtp.ServerInfo{c.serverName, c.tls, c.auth})
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: c.serverName, TLS: c.tls, Auth: c.auth})
 	if err != nil {
 		c.Quit()
 		return err
@@ -220,10 +383,10 @@ func (c *Session) Auth() error {
 			// the last message isn't base64 because it isn't a challenge
 			msg = []byte(msg64)
 		default:
-			err = &textproto.Error{Code: code, Msg: msg64}
+			err = c.replyError("AUTH", &textproto.Error{Code: code, Msg: msg64})
 		}
 		if err == nil {
-			resp, err = c.a.Next(msg, code == 334)
+			resp, err = a.Next(msg, code == 334)
 		}
 		if err != nil {
 			// abort the AUTH
@@ -238,6 +401,11 @@ func (c *Session) Auth() error {
 		encoding.Encode(resp64, resp)
 		code, msg64, err = c.cmd(0, string(resp64))
 	}
+	if fa, ok := a.(failedAuth); ok && err != nil {
+		if ferr := fa.failure(); ferr != nil {
+			err = fmt.Errorf("%w: %w", err, ferr)
+		}
+	}
 	return err
 }
 
@@ -255,6 +423,7 @@ func (c *Session) Mail(from string) error {
 			cmdStr += " BODY=8BITMIME"
 		}
 	}
+	c.accepted, c.data = c.accepted[:0], dataNone
 	_, _, err := c.cmd(250, cmdStr, from)
 	return err
 }
@@ -264,30 +433,69 @@ func (c *Session) Mail(from string) error {
 // a Data call or another Rcpt call.
 func (c *Session) Rcpt(to string) error {
 	_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
+	if err == nil {
+		c.accepted = append(c.accepted, to)
+	}
 	return err
 }
 
 type dataCloser struct {
 	c *Session
 	io.WriteCloser
+	start time.Time // when the DATA command was sent
+	n     int64     // bytes written
+}
+
+func newDataCloser(c *Session, start time.Time) *dataCloser {
+	return &dataCloser{c: c, WriteCloser: c.Text.DotWriter(), start: start}
+}
+
+func (d *dataCloser) Write(p []byte) (int, error) {
+	d.c.setDeadline(d.c.Timeouts.DataBlock)
+	n, err := d.WriteCloser.Write(p)
+	d.n += int64(n)
+	return n, err
 }
 
 func (d *dataCloser) Close() error {
-	d.WriteCloser.Close()
-	_, _, err := d.c.Text.ReadResponse(250)
+	d.c.setDeadline(d.c.Timeouts.DataBlock)
+	err := d.WriteCloser.Close()
+	if err == nil {
+		// the end of the message has been sent
+		d.c.data = dataEnded
+		d.c.setDeadline(d.c.Timeouts.DataTermination)
+		err = d.c.readDataReply()
+	}
+	d.c.observe(PhaseEvent{Phase: PhaseData, Code: replyCode(err, 250), Bytes: d.n, Err: err}, d.start)
 	return err
 }
 
+// readDataReply reads the reply to the message: a single reply or, in LMTP
+// mode, one reply for every accepted recipient.
+func (c *Session) readDataReply() error {
+	if c.LMTP {
+		return c.readDeliveries()
+	}
+	_, _, err := c.Text.ReadResponse(250)
+	return c.replyError("END-OF-DATA", err)
+}
+
 // Data issues a DATA command to the server and returns a writer that
 // can be used to write the mail headers and body. The caller should
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
+// In LMTP mode closing the writer returns a *PartialDeliveryError if the
+// message has been delivered only to some of the recipients, or the *RcptError
+// of the first recipient if it has not been delivered to any of them.
 func (c *Session) Data() (io.WriteCloser, error) {
+	start := time.Now()
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
+		c.observe(PhaseEvent{Phase: PhaseData, Code: replyCode(err, 354), Err: err}, start)
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter()}, nil
+	c.data = dataStarted
+	return newDataCloser(c, start), nil
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -318,6 +526,22 @@ func (c *Session) Reset() error {
 	return err
 }
 
+// Noop sends the NOOP command to the server. It does nothing but check
+// that the connection to the server is okay.
+func (c *Session) Noop() error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(250, "NOOP")
+	return err
+}
+
+// Messages returns the number of messages sent using this session and
+// accepted by the server, also partially in LMTP mode.
+func (c *Session) Messages() int {
+	return c.messages
+}
+
 // Quit sends the QUIT command and closes the connection to the server.
 func (c *Session) Quit() error {
 	if err := c.hello(); err != nil {
@@ -330,101 +554,368 @@ func (c *Session) Quit() error {
 	return c.Text.Close()
 }
 
+// SizeError is returned when the message is larger than the maximum size
+// declared by the server with the SIZE extension.
+type SizeError struct {
+	Size  int64 // size of the message
+	Limit int64 // maximum size accepted by the server
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("smtp: message size %d exceeds the server limit of %d bytes", e.Size, e.Limit)
+}
+
+// RcptError is returned when the server rejects a recipient.
+type RcptError struct {
+	Recipient string
+	Err       error // the *SMTPError of the reply or the failure of a retried delivery
+}
+
+func (e *RcptError) Error() string {
+	return fmt.Sprintf("recipient %s: %v", e.Recipient, e.Err)
+}
+
+// Unwrap returns the server error.
+func (e *RcptError) Unwrap() error {
+	return e.Err
+}
+
+// RcptResult is the outcome of a RCPT TO command.
+type RcptResult struct {
+	Address      string
+	Code         int
+	EnhancedCode string // RFC 3463 enhanced status code, as in "5.1.1"
+	Message      string
+}
+
+// Accepted reports whether the server accepted the recipient.
+func (r RcptResult) Accepted() bool {
+	return r.Code >= 250 && r.Code < 260
+}
+
+// rcptResult returns the result of a RCPT TO command.
+func (c *Session) rcptResult(addr string, code int, msg string, err error) RcptResult {
+	if serr, ok := err.(*SMTPError); ok {
+		return RcptResult{Address: addr, Code: serr.Code, EnhancedCode: serr.EnhancedCode, Message: serr.Message}
+	}
+	r := RcptResult{Address: addr, Code: code, Message: msg}
+	if _, ok := c.ext["ENHANCEDSTATUSCODES"]; ok {
+		r.EnhancedCode, r.Message = parseEnhancedCode(msg)
+	}
+	return r
+}
+
+// acceptedRcpts returns the number of accepted recipients.
+func acceptedRcpts(results []RcptResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Accepted() {
+			n++
+		}
+	}
+	return n
+}
+
 // MailAndRcpt issues MAIL FROM and RCPT TO commands, in sequence.
 // It will check the addresses, decide if SMTPUTF8 is needed, and apply the
 // necessary transformations.
 // If the message ReturnPath is setted, it will be used as MAIL FROM address.
 // If the message Recipient is setted, it will be used ad the only RCPT TO address.
+// If the message Recipients are setted, they will be used as RCPT TO addresses.
+// If the server supports the PIPELINING extension the commands are sent in a
+// single batch.
+// A rejected recipient is reported as a *RcptError wrapping the *SMTPError.
 func (c *Session) MailAndRcpt(msg *Email) error {
-	recipients := make([]string, 0)
+	mail, recipients, err := c.envelope(msg, msg.recipients(), 0)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.transaction(mail, recipients, false, false)
+	return err
+}
+
+// recipient is the address and the parameters of a RCPT TO command.
+type recipient struct {
+	addr   string
+	params string
+}
+
+// envelope prepares the MAIL FROM command and the list of the RCPT TO recipients
+// for the addresses. If size is greater than 0 it is declared using the SIZE parameter.
+func (c *Session) envelope(msg *Email, addrs []string, size int64) (string, []recipient, error) {
+	if err := c.requireTLS(msg); err != nil {
+		return "", nil, err
+	}
+	dsn, err := c.dsn(msg)
+	if err != nil {
+		return "", nil, err
+	}
+	params, err := c.mailParams(msg)
+	if err != nil {
+		return "", nil, err
+	}
+	recipients := make([]recipient, 0)
 	var fromNeeds bool
 	var from string
-	var err error
 	var toNeeds bool
 	// prepare MAIL FROM
 	if msg.ReturnPath != "" {
 		from, fromNeeds, err = c.prepareForSMTPUTF8(msg.ReturnPath)
 		if err != nil {
-			return err
+			return "", nil, err
 		}
 	} else {
 		from, fromNeeds, err = c.prepareForSMTPUTF8(msg.From.Address)
 		if err != nil {
-			return err
+			return "", nil, err
 		}
 	}
 	// prepare RCPT TO
-	if msg.Recipient != "" {
-		// if the Recipient is setted than use only it
-		to, needs, err := c.prepareForSMTPUTF8(msg.Recipient)
+	for _, addr := range addrs {
+		to, needs, err := c.prepareForSMTPUTF8(addr)
 		if err != nil {
-			return err
+			return "", nil, err
 		}
-		recipients = append(recipients, to)
+		recipients = append(recipients, recipient{addr: to, params: dsn.rcptParams(addr)})
 		toNeeds = toNeeds || needs
-	} else {
-		for _, rec := range msg.To {
-			to, needs, err := c.prepareForSMTPUTF8(rec.Address)
-			if err != nil {
-				return err
-			}
-			recipients = append(recipients, to)
-			toNeeds = toNeeds || needs
-		}
-		for _, rec := range msg.Cc {
-			to, needs, err := c.prepareForSMTPUTF8(rec.Address)
-			if err != nil {
-				return err
-			}
-			recipients = append(recipients, to)
-			toNeeds = toNeeds || needs
-		}
-		for _, rec := range msg.Bcc {
-			to, needs, err := c.prepareForSMTPUTF8(rec.Address)
-			if err != nil {
-				return err
-			}
-			recipients = append(recipients, to)
-			toNeeds = toNeeds || needs
-		}
 	}
 
 	smtputf8Needed := fromNeeds || toNeeds
 
-	cmdStr := "MAIL FROM:<%s>"
-	if ok, _ := c.Extension("8BITMIME"); ok {
-		cmdStr += " BODY=8BITMIME"
+	mail := fmt.Sprintf("MAIL FROM:<%s>", from)
+	if c.binaryMIME() && msg.hasBinaryParts() {
+		mail += " BODY=BINARYMIME"
+	} else if ok, _ := c.Extension("8BITMIME"); ok {
+		mail += " BODY=8BITMIME"
 	}
 	if smtputf8Needed {
-		cmdStr += " SMTPUTF8"
+		mail += " SMTPUTF8"
+	}
+	if size > 0 {
+		mail += fmt.Sprintf(" SIZE=%d", size)
+	}
+	if msg.RequireTLS == RequireTLSYes {
+		mail += " REQUIRETLS"
+	}
+	mail += dsn.mailParams() + params
+	return mail, recipients, nil
+}
+
+// dsn returns the DSN parameters of the message if the server supports them.
+func (c *Session) dsn(msg *Email) (*DSN, error) {
+	if msg.DSN == nil {
+		return nil, nil
 	}
-	_, _, err = c.cmd(250, cmdStr, from)
+	if ok, _ := c.Extension("DSN"); !ok {
+		if msg.DSN.Strict {
+			return nil, ErrDSNNotSupported
+		}
+		return nil, nil
+	}
+	return msg.DSN, msg.DSN.validate()
+}
+
+// binaryMIME reports whether the server accepts unencoded binary parts.
+func (c *Session) binaryMIME() bool {
+	ok, _ := c.Extension("BINARYMIME")
+	return ok && c.chunking()
+}
+
+// transaction sends the MAIL FROM and RCPT TO commands and, if data is true,
+// returns the writer for the message. The message is sent using BDAT if the
+// server supports CHUNKING or using DATA otherwise.
+// It returns the outcome of every RCPT TO command sent.
+func (c *Session) transaction(mail string, recipients []recipient, data, binary bool) ([]RcptResult, io.WriteCloser, error) {
+	bdat := data && c.chunking()
+	c.accepted, c.delivered, c.data = c.accepted[:0], c.delivered[:0], dataNone
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		results, w, err := c.pipelinedTransaction(mail, recipients, data && !bdat)
+		if err != nil || !bdat {
+			return results, w, err
+		}
+		return results, c.Bdat(binary), nil
+	}
+	start := time.Now()
+	code, _, err := c.cmd(250, "%s", mail)
+	c.observe(PhaseEvent{Phase: PhaseMail, Code: code, Err: err}, start)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	results := make([]RcptResult, 0, len(recipients))
+	var rcptErr error
 	for _, to := range recipients {
-		_, _, err = c.cmd(25, "RCPT TO:<%s>", to)
-		if err != nil {
-			return err
+		start := time.Now()
+		code, msg, err := c.cmd(25, "RCPT TO:<%s>%s", to.addr, to.params)
+		c.observe(PhaseEvent{Phase: PhaseRcpt, Code: code, Recipient: to.addr, Err: err}, start)
+		results = append(results, c.rcptResult(to.addr, code, msg, err))
+		if err == nil {
+			c.accepted = append(c.accepted, to.addr)
+		}
+		_, ok := err.(*SMTPError)
+		if ok {
+			err = &RcptError{Recipient: to.addr, Err: err}
+		}
+		if err != nil && (!ok || !c.PartialDelivery) {
+			return results, nil, err
 		}
+		if err != nil && rcptErr == nil {
+			rcptErr = err
+		}
+	}
+	if acceptedRcpts(results) == 0 {
+		return results, nil, rcptErr
+	}
+	if !data {
+		return results, nil, nil
+	}
+	if bdat {
+		return results, c.Bdat(binary), nil
+	}
+	w, err := c.Data()
+	return results, w, err
+}
+
+// pipelinedTransaction sends MAIL FROM, all the RCPT TO and DATA in a single
+// batch (RFC 2920) and then reads the replies in order.
+func (c *Session) pipelinedTransaction(mail string, recipients []recipient, data bool) ([]RcptResult, io.WriteCloser, error) {
+	ids := make([]uint, 0, len(recipients)+2)
+	var werr error
+	c.startTrace()
+	c.setDeadline(c.Timeouts.Mail)
+	send := func(format string, args ...interface{}) {
+		if werr != nil {
+			return
+		}
+		var id uint
+		id, werr = c.Text.Cmd(format, args...)
+		ids = append(ids, id)
+	}
+	send("%s", mail)
+	for _, to := range recipients {
+		send("RCPT TO:<%s>%s", to.addr, to.params)
+	}
+	if data {
+		send("DATA")
+	}
+	if werr != nil {
+		// release the pipeline, no reply is coming
+		for _, id := range ids {
+			c.Text.StartResponse(id)
+			c.Text.EndResponse(id)
+		}
+		return nil, nil, werr
+	}
+	// the duration of every phase is the time spent waiting for its reply
+	read := func(id uint, expectCode int, command string, timeout time.Duration) (int, string, error) {
+		c.setDeadline(timeout)
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		code, msg, err := c.Text.ReadResponse(expectCode)
+		return code, msg, c.replyError(command, err)
+	}
+	start := time.Now()
+	code, _, err := read(ids[0], 250, "MAIL", c.Timeouts.Mail)
+	c.observe(PhaseEvent{Phase: PhaseMail, Code: code, Err: err}, start)
+	results := make([]RcptResult, 0, len(recipients))
+	var rcptErr error
+	for i, to := range recipients {
+		start := time.Now()
+		code, msg, rerr := read(ids[i+1], 25, "RCPT", c.Timeouts.Rcpt)
+		c.observe(PhaseEvent{Phase: PhaseRcpt, Code: code, Recipient: to.addr, Err: rerr}, start)
+		if err == nil {
+			results = append(results, c.rcptResult(to.addr, code, msg, rerr))
+		}
+		if _, ok := rerr.(*SMTPError); ok {
+			rerr = &RcptError{Recipient: to.addr, Err: rerr}
+		}
+		if err == nil && rerr == nil {
+			c.accepted = append(c.accepted, to.addr)
+		}
+		if rerr != nil && rcptErr == nil {
+			rcptErr = rerr
+		}
+	}
+	if err == nil && rcptErr != nil && (!c.PartialDelivery || acceptedRcpts(results) == 0) {
+		err = rcptErr
+	}
+	if !data {
+		return results, nil, err
+	}
+	start = time.Now()
+	_, _, derr := read(ids[len(ids)-1], 354, "DATA", c.Timeouts.DataInit)
+	if derr != nil {
+		c.observe(PhaseEvent{Phase: PhaseData, Code: replyCode(derr, 354), Err: derr}, start)
+	}
+	if err != nil {
+		if derr == nil {
+			return results, nil, c.abortData(err)
+		}
+		return results, nil, err
+	}
+	if derr != nil {
+		return results, nil, derr
+	}
+	c.data = dataStarted
+	return results, newDataCloser(c, start), nil
+}
+
+// abortData aborts a pipelined transaction whose DATA has been accepted by
+// the server although the transaction failed with err.
+// If no recipient has been accepted an empty message is sent, as RFC 2920
+// suggests, and the server rejects it keeping the session usable.
+// Otherwise the empty message would be delivered to the accepted recipients:
+// the connection is closed and the returned error wraps net.ErrClosed too.
+func (c *Session) abortData(err error) error {
+	if len(c.accepted) > 0 {
+		c.Text.Close()
+		return fmt.Errorf("%w (connection closed to abort the message: %w)", err, net.ErrClosed)
+	}
+	c.setDeadline(c.Timeouts.DataTermination)
+	if werr := c.Text.PrintfLine("."); werr != nil {
+		return werr
+	}
+	if _, _, rerr := c.Text.ReadResponse(250); rerr != nil {
+		if _, ok := rerr.(*textproto.Error); !ok {
+			return rerr
+		}
+	}
+	return err
+}
+
+// tlsConfig returns the TLS configuration used for STARTTLS.
+func (c *Session) tlsConfig() *tls.Config {
+	return tlsClientConfig(c.TLSConfig, c.serverName)
+}
+
+// checkTLS verifies that the connection is encrypted when the TLS policy is TLSMandatory.
+func (c *Session) checkTLS() error {
+	if c.TLSPolicy == TLSMandatory && !c.tls {
+		return ErrTLSNotAvailable
 	}
 	return nil
 }
 
 // StartSession opens an SMTP session.
+// It switches to TLS using STARTTLS following the TLS policy if the connection
+// is not already encrypted, then it authenticates if the server supports AUTH.
 func (c *Session) StartSession() error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: c.serverName}
-		if testHookStartTLS != nil {
-			testHookStartTLS(config)
-		}
-		if err := c.StartTLS(config); err != nil {
-			return err
+	if !c.tls && c.TLSPolicy != TLSDisabled {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			config := c.tlsConfig()
+			if testHookStartTLS != nil {
+				testHookStartTLS(config)
+			}
+			if err := c.StartTLS(config); err != nil {
+				return err
+			}
 		}
 	}
+	if err := c.checkTLS(); err != nil {
+		return err
+	}
 	if c.a != nil && c.ext != nil {
 		if _, ok := c.ext["AUTH"]; ok {
 			if err := c.Auth(); err != nil {
@@ -438,33 +929,98 @@ func (c *Session) StartSession() error {
 // SendSingleMessage sends a single email to the recipient.
 // The method requires that the session is open and leaves it open.
 func (c *Session) SendSingleMessage(msg *Email) error {
+	_, err := c.SendSingleMessageResults(msg)
+	return err
+}
+
+// SendSingleMessageResults sends a single email to the recipient and returns
+// the outcome of every RCPT TO command.
+// If PartialDelivery is true the message is delivered to the accepted
+// recipients and the rejected ones are reported only in the results.
+// In LMTP mode the results of the accepted recipients are replaced by the
+// outcome of the delivery to their mailboxes and a *PartialDeliveryError
+// reports the recipients the message has not been delivered to.
+// The method requires that the session is open and leaves it open.
+func (c *Session) SendSingleMessageResults(msg *Email) ([]RcptResult, error) {
+	return c.sendTo(msg, msg.recipients())
+}
+
+// sendTo sends the message using the addresses as envelope recipients.
+func (c *Session) sendTo(msg *Email, addrs []string) ([]RcptResult, error) {
 	if msg.From.Address == "" {
-		return errors.New("From address can not be empty")
+		return nil, errors.New("From address can not be empty")
 	}
-	if msg.Recipient == "" && len(msg.To) == 0 && len(msg.Cc) == 0 && len(msg.Bcc) == 0 {
-		return errors.New("Recipient addresses can not be empty")
+	if len(addrs) == 0 {
+		return nil, errors.New("Recipient addresses can not be empty")
 	}
-	if err := c.MailAndRcpt(msg); err != nil {
-		c.Reset()
-		return err
+	start := time.Now()
+	results, n, err := c.send(msg, addrs)
+	c.observe(PhaseEvent{Phase: PhaseMessage, Code: replyCode(err, 250), Bytes: n, Err: err}, start)
+	var perr *PartialDeliveryError
+	if err == nil || errors.As(err, &perr) {
+		// only the messages accepted by the server are counted
+		c.messages++
 	}
-	w, err := c.Data()
+	return results, err
+}
+
+// send sends the message to the addresses and returns the number of bytes of the message sent.
+func (c *Session) send(msg *Email, addrs []string) ([]RcptResult, int64, error) {
+	binary := msg.hasBinaryParts()
+	if binary && !c.binaryMIME() {
+		// the Message-Id is still generated on the message, as when it is written
+		msg.setMessageID()
+		msg = msg.downgradeBinaryParts()
+		binary = false
+	}
+	// if the server declares a maximum size, the message is rendered
+	// before starting the transaction to check and declare its size
+	var body *bytes.Buffer
+	var size int64
+	if ok, param := c.Extension("SIZE"); ok {
+		body = &bytes.Buffer{}
+		if err := msg.Write(body); err != nil {
+			return nil, 0, err
+		}
+		size = int64(body.Len())
+		if limit, _ := strconv.ParseInt(param, 10, 64); limit > 0 && size > limit {
+			return nil, 0, &SizeError{Size: size, Limit: limit}
+		}
+	}
+	mail, recipients, err := c.envelope(msg, addrs, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	results, w, err := c.transaction(mail, recipients, true, binary)
 	if err != nil {
 		c.Reset()
-		return err
+		return results, 0, err
+	}
+	cw := &countWriter{Writer: w}
+	if body != nil {
+		_, err = body.WriteTo(cw)
+	} else {
+		err = msg.Write(cw)
 	}
-	err = msg.Write(w)
 	if err != nil {
-		return err
+		return results, cw.n, err
 	}
 	err = w.Close()
+	if c.LMTP {
+		results = mergeDeliveries(results, c.delivered)
+	}
 	if err != nil {
-		return err
+		return results, cw.n, err
 	}
-	return nil
+	return results, cw.n, nil
 }
 
 // SendMessageBulk sends a list of messages to an SMTP server using the same connection and at the end closes the session and the connection.
+// If the session has been opened by a SessionDialer (as with NewSession), when
+// the connection is lost, a message is interrupted or the server replies 421
+// it reconnects, starts a new session and sends again the failed message,
+// unless the connection was lost after the end of the message was sent. It also reconnects after
+// MaxMessagesPerConnection messages.
 func (c *Session) SendMessageBulk(messages []*Email) (SendBulkReport, error) {
 	report := make(SendBulkReport, 0)
 	defer c.Close()
@@ -472,20 +1028,29 @@ func (c *Session) SendMessageBulk(messages []*Email) (SendBulkReport, error) {
 	if err != nil {
 		return report, err
 	}
+	var broken error // error of the last reconnection
 	for _, msg := range messages {
-		err := c.SendSingleMessage(msg)
-		report = append(report, SendBulkReportItem{MessageID: msg.MessageID, Sent: err == nil, Err: err})
+		if broken != nil {
+			report = append(report, SendBulkReportItem{MessageID: msg.MessageID, Err: broken})
+			continue
+		}
+		var item SendBulkReportItem
+		item, broken = c.sendBulk(msg)
+		report = append(report, item)
+	}
+	if broken != nil {
+		return report, broken
 	}
 	return report, c.Quit()
 }
 
 // prepareForSMTPUTF8 prepares the address for SMTPUTF8.
 // It returns:
-//  - The address to use. It is based on addr, and possibly modified to make
-//    it not need the extension, if the server does not support it.
-//  - Whether the address needs the extension or not.
-//  - An error if the address needs the extension, but the client does not
-//    support it.
+//   - The address to use. It is based on addr, and possibly modified to make
+//     it not need the extension, if the server does not support it.
+//   - Whether the address needs the extension or not.
+//   - An error if the address needs the extension, but the client does not
+//     support it.
 func (c *Session) prepareForSMTPUTF8(addr string) (string, bool, error) {
 	// ASCII address pass through.
 	if isASCII(addr) {
@@ -534,21 +1099,6 @@ func isASCII(s string) bool {
 	return true
 }
 
-// IsPermanent returns true if the error is permanent, and false otherwise.
-// If it can't tell, it returns false.
-func IsPermanent(err error) bool {
-	terr, ok := err.(*textproto.Error)
-	if !ok {
-		return false
-	}
-	// Error codes 5yz are permanent.
-	// https://tools.ietf.org/html/rfc5321#section-4.2.1
-	if terr.Code >= 500 && terr.Code < 600 {
-		return true
-	}
-	return false
-}
-
 // SendMail connects to the server at addr, switches to TLS if
 // possible, authenticates with the optional mechanism a if possible,
 // and then sends an email from address from, to addresses to, with
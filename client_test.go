@@ -1,8 +1,20 @@
 package mandala
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/maxzerbini/mandala/mandalatest"
 )
 
 func TestSendMail(t *testing.T) {
@@ -11,18 +23,312 @@ func TestSendMail(t *testing.T) {
 		a    smtp.Auth
 		msg  *Email
 	}
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
 	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
+		name     string
+		args     args
+		tls      bool
+		users    map[string]string
+		script   []string // verb followed by its scripted reply
+		wantErr  bool
+		wantSent bool
 	}{
-	// TODO: Add test cases.
+		{name: "sent", args: args{msg: msg}, wantSent: true},
+		{name: "starttls", args: args{msg: msg}, tls: true, wantSent: true},
+		{name: "authenticated", args: args{a: smtp.PlainAuth("", "user", "secret", "127.0.0.1"), msg: msg},
+			users: map[string]string{"user": "secret"}, wantSent: true},
+		{name: "wrong password", args: args{a: smtp.PlainAuth("", "user", "wrong", "127.0.0.1"), msg: msg},
+			users: map[string]string{"user": "secret"}, wantErr: true},
+		// the errors sending the message are not returned
+		{name: "rejected", args: args{msg: msg}, script: []string{"RCPT", "550 5.1.1 no such user"}},
+		{name: "greeting refused", args: args{msg: msg}, script: []string{"GREETING", "554 no service"}, wantErr: true},
+		{name: "connection refused", args: args{addr: "127.0.0.1:1", msg: msg}, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			s := mandalatest.NewUnstartedServer("8BITMIME", "PIPELINING", "SMTPUTF8")
+			s.Users = tt.users
+			if len(tt.script) > 0 {
+				s.Script(tt.script[0], tt.script[1:]...)
+			}
+			if tt.tls {
+				s.StartTLS()
+				testHookStartTLS = func(config *tls.Config) { config.RootCAs = s.ClientTLSConfig().RootCAs }
+				defer func() { testHookStartTLS = nil }()
+			} else {
+				s.Start()
+			}
+			defer s.Close()
+			if tt.args.addr == "" {
+				tt.args.addr = s.Addr
+			}
 			if err := SendMail(tt.args.addr, tt.args.a, tt.args.msg); (err != nil) != tt.wantErr {
 				t.Errorf("SendMail() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			messages := s.Messages()
+			if sent := len(messages) == 1; sent != tt.wantSent {
+				t.Fatalf("Server.Messages() = %d messages, want sent %v", len(messages), tt.wantSent)
+			}
+			if !tt.wantSent {
+				return
+			}
+			if got := messages[0]; got.TLS != tt.tls || got.From != "from@test.com" || len(got.To) != 1 || got.To[0].Address != "to@test.com" {
+				t.Errorf("Server.Messages()[0] = TLS %v from %q to %v, want TLS %v from from@test.com to to@test.com", got.TLS, got.From, got.To, tt.tls)
+			}
+			FindSnippets(t, string(messages[0].Data), []string{"Subject: Hello\r\n", "Hello world!"})
+		})
+	}
+}
+
+// faker is a fake connection: the client reads the scripted server replies
+// and its commands are recorded.
+type faker struct {
+	io.Reader
+	io.Writer
+}
+
+func (f faker) Close() error                     { return nil }
+func (f faker) LocalAddr() net.Addr              { return nil }
+func (f faker) RemoteAddr() net.Addr             { return nil }
+func (f faker) SetDeadline(time.Time) error      { return nil }
+func (f faker) SetReadDeadline(time.Time) error  { return nil }
+func (f faker) SetWriteDeadline(time.Time) error { return nil }
+
+// newFakeSession returns a session reading the server replies and the buffer
+// where the client commands are written.
+func newFakeSession(t *testing.T, server ...string) (*Session, *bytes.Buffer) {
+	cmds := &bytes.Buffer{}
+	conn := faker{Reader: strings.NewReader(strings.Join(server, "\r\n") + "\r\n"), Writer: cmds}
+	c, err := NewSessionUsingConnection(conn, "fake.host", nil)
+	if err != nil {
+		t.Fatalf("NewSessionUsingConnection() error = %v", err)
+	}
+	return c, cmds
+}
+
+func TestSession_SendSingleMessage(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name     string
+		server   []string
+		wantErr  bool
+		snippets []string
+	}{
+		{name: "sent", server: []string{"220 hello", "250-fake.host", "250 8BITMIME", "250 ok", "250 ok", "354 go", "250 queued"},
+			snippets: []string{"EHLO localhost\r\n", "MAIL FROM:<from@test.com> BODY=8BITMIME\r\n", "RCPT TO:<to@test.com>\r\n", "DATA\r\n", "\r\n.\r\n"}},
+		{name: "recipient rejected", server: []string{"220 hello", "250 fake.host", "250 ok", "550 no such user", "250 reset"}, wantErr: true,
+			snippets: []string{"RCPT TO:<to@test.com>\r\n", "RSET\r\n"}},
+		{name: "size declared", server: []string{"220 hello", "250-fake.host", "250 SIZE 1000000", "250 ok", "250 ok", "354 go", "250 queued"},
+			snippets: []string{"MAIL FROM:<from@test.com> SIZE="}},
+		{name: "size exceeded", server: []string{"220 hello", "250-fake.host", "250 SIZE 10"}, wantErr: true},
+		{name: "pipelined", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "250 ok", "354 go", "250 queued"},
+			snippets: []string{"MAIL FROM:<from@test.com>\r\nRCPT TO:<to@test.com>\r\nDATA\r\n", "\r\n.\r\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cmds := newFakeSession(t, tt.server...)
+			if err := c.SendSingleMessage(msg); (err != nil) != tt.wantErr {
+				t.Errorf("Session.SendSingleMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			FindSnippets(t, cmds.String(), tt.snippets)
+		})
+	}
+}
+
+func TestSession_SendSingleMessage_PipelinedAbort(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}, EmailAddress{Address: "to2@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name        string
+		server      []string
+		wantClosed  bool
+		wantMessage bool // whether an empty message is sent after DATA
+	}{
+		{name: "all rejected", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "550 no such user", "550 no such user", "354 go", "554 no valid recipients", "250 reset"},
+			wantMessage: true},
+		{name: "second rejected", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "250 ok", "550 no such user", "354 go"},
+			wantClosed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cmds := newFakeSession(t, tt.server...)
+			err := c.SendSingleMessage(msg)
+			var rerr *RcptError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("Session.SendSingleMessage() error = %v, want a rejected recipient", err)
+			}
+			if errors.Is(err, net.ErrClosed) != tt.wantClosed {
+				t.Errorf("Session.SendSingleMessage() error = %v, want net.ErrClosed %v", err, tt.wantClosed)
+			}
+			if got := strings.Contains(cmds.String(), "DATA\r\n.\r\n"); got != tt.wantMessage {
+				t.Errorf("empty message sent = %v, want %v: %q", got, tt.wantMessage, cmds.String())
+			}
+			if tt.wantMessage {
+				FindSnippets(t, cmds.String(), []string{"DATA\r\n.\r\nRSET\r\n"})
+			}
+		})
+	}
+}
+
+// newTLSListener returns a loopback TLS listener using the self-signed
+// certificate of net/http/httptest and a client configuration trusting it.
+func newTLSListener(t *testing.T) (net.Listener, *tls.Config) {
+	s := httptest.NewUnstartedServer(http.NotFoundHandler())
+	s.StartTLS()
+	serverConfig := s.TLS.Clone()
+	clientConfig := s.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	s.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	return l, clientConfig
+}
+
+func TestNewSessionTLS(t *testing.T) {
+	l, config := newTLSListener(t)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 hello")
+		text.ReadLine()
+		text.PrintfLine("250-example.com\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+		line, _ := text.ReadLine()
+		text.PrintfLine("235 ok")
+		received <- line
+	}()
+	config.ServerName = "example.com"
+	c, err := NewSessionTLS(l.Addr().String(), smtp.PlainAuth("", "user", "pass", "example.com"), config)
+	if err != nil {
+		t.Fatalf("NewSessionTLS() error = %v", err)
+	}
+	defer c.Close()
+	c.serverName = "example.com"
+	if err := c.StartSession(); err != nil {
+		t.Errorf("Session.StartSession() error = %v", err)
+	}
+	if line := <-received; !strings.HasPrefix(line, "AUTH PLAIN ") {
+		t.Errorf("Session.StartSession() sent %q, want AUTH PLAIN", line)
+	}
+	if _, ok := c.TLSConnectionState(); !ok {
+		t.Errorf("Session.TLSConnectionState() ok = false, want true")
+	}
+}
+
+func TestSession_StartSession_TLSPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  TLSPolicy
+		server  []string
+		wantErr error
+	}{
+		{name: "mandatory without STARTTLS", policy: TLSMandatory, server: []string{"220 hello", "250 fake.host"}, wantErr: ErrTLSNotAvailable},
+		{name: "opportunistic without STARTTLS", policy: TLSOpportunistic, server: []string{"220 hello", "250 fake.host"}},
+		{name: "disabled with STARTTLS", policy: TLSDisabled, server: []string{"220 hello", "250-fake.host", "250 STARTTLS"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cmds := newFakeSession(t, tt.server...)
+			c.TLSPolicy = tt.policy
+			if err := c.StartSession(); err != tt.wantErr {
+				t.Errorf("Session.StartSession() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if strings.Contains(cmds.String(), "STARTTLS") {
+				t.Errorf("Session.StartSession() sent STARTTLS")
+			}
+		})
+	}
+}
+
+func TestSession_MailAndRcpt_Pipelining(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}, EmailAddress{Address: "to2@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name     string
+		server   []string
+		wantRcpt string
+	}{
+		{name: "all accepted", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "250 ok", "250 ok"}},
+		{name: "second rejected", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "250 ok", "550 no such user"}, wantRcpt: "to2@test.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cmds := newFakeSession(t, tt.server...)
+			err := c.MailAndRcpt(msg)
+			if tt.wantRcpt == "" && err != nil {
+				t.Errorf("Session.MailAndRcpt() error = %v", err)
+			}
+			if tt.wantRcpt != "" {
+				rerr, ok := err.(*RcptError)
+				var serr *SMTPError
+				if !ok || rerr.Recipient != tt.wantRcpt || !errors.As(err, &serr) || serr.Command != "RCPT" || !IsPermanent(err) {
+					t.Errorf("Session.MailAndRcpt() error = %v, want rejected %v", err, tt.wantRcpt)
+				}
+			}
+			FindSnippets(t, cmds.String(), []string{"MAIL FROM:<from@test.com>\r\nRCPT TO:<to1@test.com>\r\nRCPT TO:<to2@test.com>\r\n"})
+		})
+	}
+}
+
+func TestSession_SendSingleMessage_SizeExceeded(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	c, cmds := newFakeSession(t, "220 hello", "250-fake.host", "250 SIZE 10")
+	err := c.SendSingleMessage(msg)
+	if serr, ok := err.(*SizeError); !ok || serr.Limit != 10 || serr.Size <= 10 {
+		t.Errorf("Session.SendSingleMessage() error = %v, want *SizeError", err)
+	}
+	if strings.Contains(cmds.String(), "MAIL FROM") {
+		t.Errorf("Session.SendSingleMessage() sent MAIL FROM")
+	}
+}
+
+func TestSession_SendSingleMessageResults_PartialDelivery(t *testing.T) {
+	tests := []struct {
+		name         string
+		partial      bool
+		server       []string
+		wantErr      bool
+		wantAccepted []bool
+		wantEnhanced string
+	}{
+		{name: "partial delivery", partial: true,
+			server:       []string{"220 hello", "250-fake.host", "250 ENHANCEDSTATUSCODES", "250 ok", "250 2.1.5 ok", "550 5.1.1 no such user", "354 go", "250 queued"},
+			wantAccepted: []bool{true, false}, wantEnhanced: "5.1.1"},
+		{name: "partial delivery pipelined", partial: true,
+			server:       []string{"220 hello", "250-fake.host", "250-PIPELINING", "250 ENHANCEDSTATUSCODES", "250 ok", "550 5.1.1 no such user", "250 2.1.5 ok", "354 go", "250 queued"},
+			wantAccepted: []bool{false, true}, wantEnhanced: "5.1.1"},
+		{name: "all rejected", partial: true,
+			server:  []string{"220 hello", "250-fake.host", "250 ENHANCEDSTATUSCODES", "250 ok", "550 5.1.1 no such user", "550 5.1.1 no such user", "250 reset"},
+			wantErr: true, wantAccepted: []bool{false, false}, wantEnhanced: "5.1.1"},
+		{name: "strict", partial: false,
+			server:  []string{"220 hello", "250-fake.host", "250 ENHANCEDSTATUSCODES", "250 ok", "250 2.1.5 ok", "550 5.1.1 no such user", "250 reset"},
+			wantErr: true, wantAccepted: []bool{true, false}, wantEnhanced: "5.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}}, "Hello", "", "Hello world!")
+			msg.Cc = []EmailAddress{EmailAddress{Address: "to2@test.com"}}
+			c, _ := newFakeSession(t, tt.server...)
+			c.PartialDelivery = tt.partial
+			results, err := c.SendSingleMessageResults(msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Session.SendSingleMessageResults() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(results) != len(tt.wantAccepted) {
+				t.Fatalf("Session.SendSingleMessageResults() results = %v", results)
+			}
+			for i, r := range results {
+				if r.Accepted() != tt.wantAccepted[i] {
+					t.Errorf("RcptResult %s Accepted() = %v, want %v", r.Address, r.Accepted(), tt.wantAccepted[i])
+				}
+				if !r.Accepted() && (r.EnhancedCode != tt.wantEnhanced || r.Message != "no such user") {
+					t.Errorf("RcptResult %s = %+v, want enhanced code %v", r.Address, r, tt.wantEnhanced)
+				}
+			}
 		})
 	}
 }
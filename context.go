@@ -0,0 +1,152 @@
+package mandala
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Timeouts contains the timeouts of the SMTP phases, as suggested by RFC 5321
+// section 4.5.3.2. A zero value disables the timeout of the phase.
+type Timeouts struct {
+	Greeting        time.Duration // waiting for the 220 greeting
+	Command         time.Duration // EHLO, STARTTLS, AUTH and the other commands
+	Mail            time.Duration // MAIL command
+	Rcpt            time.Duration // RCPT command
+	DataInit        time.Duration // DATA command
+	DataBlock       time.Duration // every data block sent
+	DataTermination time.Duration // waiting for the reply to the end of the data
+}
+
+// DefaultTimeouts contains the timeouts suggested by RFC 5321.
+var DefaultTimeouts = Timeouts{
+	Greeting:        5 * time.Minute,
+	Command:         5 * time.Minute,
+	Mail:            5 * time.Minute,
+	Rcpt:            5 * time.Minute,
+	DataInit:        2 * time.Minute,
+	DataBlock:       3 * time.Minute,
+	DataTermination: 10 * time.Minute,
+}
+
+// command returns the timeout of the command line.
+func (t Timeouts) command(line string) time.Duration {
+	switch verb := commandName(line); {
+	case strings.HasPrefix(verb, "MAIL"):
+		return t.Mail
+	case strings.HasPrefix(verb, "RCPT"):
+		return t.Rcpt
+	case verb == "DATA":
+		return t.DataInit
+	case verb == "BDAT":
+		return t.DataBlock
+	}
+	return t.Command
+}
+
+// DialContext returns a new client Session connected to an SMTP server at host.
+// The host must include a port, as in "mail.example.com:smtp".
+// The session uses DefaultTimeouts and the context deadline applies to the
+// connection and to the greeting.
+func DialContext(ctx context.Context, host string, a smtp.Auth) (*Session, error) {
+	d := &SessionDialer{Address: host, Auth: a, Timeouts: DefaultTimeouts}
+	return d.DialContext(ctx)
+}
+
+// StartSessionContext is like StartSession but it aborts when the context is done.
+func (c *Session) StartSessionContext(ctx context.Context) error {
+	return c.runContext(ctx, c.StartSession)
+}
+
+// SendSingleMessageContext is like SendSingleMessage but it aborts when the context is done.
+func (c *Session) SendSingleMessageContext(ctx context.Context, msg *Email) error {
+	return c.runContext(ctx, func() error {
+		return c.SendSingleMessage(msg)
+	})
+}
+
+// SendMessageBulkContext is like SendMessageBulk but it aborts when the context is done.
+// The messages not sent are reported with the context error.
+func (c *Session) SendMessageBulkContext(ctx context.Context, messages []*Email) (SendBulkReport, error) {
+	var report SendBulkReport
+	err := c.runContext(ctx, func() error {
+		var err error
+		report, err = c.SendMessageBulk(messages)
+		return err
+	})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		for i := range report {
+			if isTimeout(report[i].Err) {
+				report[i].Err = ctxErr
+			}
+		}
+		for _, msg := range messages[len(report):] {
+			report = append(report, SendBulkReportItem{MessageID: msg.MessageID, Err: ctxErr})
+		}
+	}
+	return report, err
+}
+
+// runContext runs f applying the context deadline to the connection and
+// interrupting the I/O operations when the context is done.
+func (c *Session) runContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.ctx == ctx {
+			c.conn.SetDeadline(time.Unix(1, 0))
+		}
+	})
+	err := f()
+	stop()
+	c.mu.Lock()
+	c.ctx = nil
+	c.mu.Unlock()
+	c.setDeadline(0)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if d, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(d) {
+		// the connection deadline expired just before the context
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// isTimeout reports whether the error is a network timeout.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// setDeadline sets the deadline of the connection for an operation that
+// should complete within timeout, keeping the context deadline into account.
+func (c *Session) setDeadline(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil && timeout <= 0 && !c.deadline {
+		return
+	}
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if c.ctx != nil {
+		if c.ctx.Err() != nil {
+			t = time.Unix(1, 0)
+		} else if d, ok := c.ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+			t = d
+		}
+	}
+	c.deadline = !t.IsZero()
+	c.conn.SetDeadline(t)
+}
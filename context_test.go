@@ -0,0 +1,76 @@
+package mandala
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// newStallingServer returns a server that sends the greeting lines and then
+// stops answering.
+func newStallingServer(t *testing.T, greeting ...string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		for _, line := range greeting {
+			text.PrintfLine("%s", line)
+			text.ReadLine()
+		}
+		time.Sleep(5 * time.Second)
+	}()
+	return l
+}
+
+func TestDialContext_Timeout(t *testing.T) {
+	l := newStallingServer(t)
+	defer l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := DialContext(ctx, l.Addr().String(), nil); err != context.DeadlineExceeded {
+		t.Errorf("DialContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("DialContext() did not abort promptly")
+	}
+}
+
+func TestSession_StartSessionContext_Cancel(t *testing.T) {
+	l := newStallingServer(t, "220 hello")
+	defer l.Close()
+	c, err := DialContext(context.Background(), l.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := c.StartSessionContext(ctx); err != context.Canceled {
+		t.Errorf("Session.StartSessionContext() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSession_Timeouts(t *testing.T) {
+	l := newStallingServer(t, "220 hello")
+	defer l.Close()
+	c, err := NewSession(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("NewSession() error = %v", err)
+	}
+	defer c.Close()
+	c.Timeouts.Command = 100 * time.Millisecond
+	err = c.StartSession()
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("Session.StartSession() error = %v, want timeout", err)
+	}
+}
@@ -0,0 +1,228 @@
+package mandala
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"time"
+)
+
+// Dialer opens network connections. *net.Dialer, HTTPProxy and the SOCKS5
+// dialers of golang.org/x/net/proxy implement Dialer.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// ContextDialer is a Dialer that can be canceled with a context.
+// *net.Dialer, HTTPProxy and the SOCKS5 dialers of golang.org/x/net/proxy
+// implement ContextDialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// SessionDialer opens sessions using a pluggable Dialer.
+// A local source IP is bound using a *net.Dialer with LocalAddr, as in
+//
+//	&SessionDialer{Address: "mail.example.com:25", Dialer: &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}}
+type SessionDialer struct {
+	// Network is "tcp" (the default), "tcp4" or "tcp6" to choose the IP
+	// version, or "unix" for Unix domain sockets.
+	Network string
+	// Address is the address dialed, as in "mail.example.com:25" or "/var/run/dovecot/lmtp".
+	Address string
+	// ServerName is the name of the server used for TLS SNI, for the
+	// verification of the certificate and for AUTH. The default is the host
+	// of Address, or "localhost" for Unix domain sockets.
+	ServerName string
+	// Dialer opens the connections, if nil a net.Dialer is used.
+	// If it implements ContextDialer the context is passed to it.
+	Dialer Dialer
+	// Auth is the authentication mechanism of the sessions.
+	Auth smtp.Auth
+	// ImplicitTLS encrypts the connection before the greeting (SMTPS, port 465).
+	ImplicitTLS bool
+	// TLSPolicy and TLSConfig are applied to the sessions.
+	TLSPolicy TLSPolicy
+	TLSConfig *tls.Config
+	// Timeouts are applied to the sessions, the Greeting timeout applies to the dial.
+	Timeouts Timeouts
+	// LMTP opens sessions in LMTP mode.
+	LMTP bool
+}
+
+// Dial opens a new session.
+func (d *SessionDialer) Dial() (*Session, error) {
+	return d.DialContext(context.Background())
+}
+
+// DialContext opens a new session and reads the greeting. The context applies
+// to the connection, to the TLS handshake and to the greeting.
+func (d *SessionDialer) DialContext(ctx context.Context) (*Session, error) {
+	start := time.Now()
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := newSession(conn, d.serverName(), d.Auth)
+	c.TLSPolicy = d.TLSPolicy
+	c.TLSConfig = d.TLSConfig
+	c.Timeouts = d.Timeouts
+	c.LMTP = d.LMTP
+	dialer := *d
+	c.dialer = &dialer
+	err = c.runContext(ctx, func() error {
+		c.setDeadline(c.Timeouts.Greeting)
+		return c.greeting(start)
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial opens a connection, encrypted if ImplicitTLS is true.
+func (d *SessionDialer) dial(ctx context.Context) (net.Conn, error) {
+	network := d.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := dialContext(ctx, d.Dialer, network, d.Address)
+	if err != nil {
+		return nil, err
+	}
+	if d.ImplicitTLS {
+		tc := tls.Client(conn, tlsClientConfig(d.TLSConfig, d.serverName()))
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return conn, nil
+}
+
+// serverName returns the name of the server.
+func (d *SessionDialer) serverName() string {
+	if d.ServerName != "" {
+		return d.ServerName
+	}
+	if d.Network == "unix" {
+		return "localhost"
+	}
+	host, _, _ := net.SplitHostPort(d.Address)
+	return host
+}
+
+// dialContext opens a connection with the dialer, using a net.Dialer if it is nil.
+func dialContext(ctx context.Context, d Dialer, network, address string) (net.Conn, error) {
+	switch d := d.(type) {
+	case nil:
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, address)
+	case ContextDialer:
+		return d.DialContext(ctx, network, address)
+	default:
+		return d.Dial(network, address)
+	}
+}
+
+// tlsClientConfig returns a copy of the TLS configuration with the server
+// name set if it is empty.
+func tlsClientConfig(config *tls.Config, serverName string) *tls.Config {
+	if config == nil {
+		return &tls.Config{ServerName: serverName}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	return config
+}
+
+// HTTPProxy is a Dialer connecting through an HTTP proxy with the CONNECT method.
+type HTTPProxy struct {
+	// Address is the address of the proxy, as in "proxy.example.com:3128".
+	Address string
+	// Username and Password are sent with basic authentication if Username is not empty.
+	Username string
+	Password string
+	// Forward opens the connections to the proxy, if nil a net.Dialer is used.
+	Forward Dialer
+}
+
+// Dial connects to the address through the proxy.
+func (p *HTTPProxy) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address through the proxy.
+func (p *HTTPProxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := dialContext(ctx, p.Forward, "tcp", p.Address)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	conn, err = p.connect(conn, address)
+	if !stop() || ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect sends the CONNECT request and reads the response of the proxy.
+func (p *HTTPProxy) connect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if p.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("mandala: proxy CONNECT to %s failed: %s", address, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		// the server has already sent the greeting
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes have been buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,142 @@
+package mandala
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+)
+
+// recordDialer is a Dialer recording the addresses dialed.
+type recordDialer struct {
+	network, address string
+}
+
+func (d *recordDialer) Dial(network, address string) (net.Conn, error) {
+	d.network, d.address = network, address
+	return net.Dial(network, address)
+}
+
+// serveQuit accepts a connection and replies to EHLO and QUIT.
+func serveQuit(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 hello")
+	for _, reply := range []string{"250 localhost", "221 bye"} {
+		text.ReadLine()
+		text.PrintfLine(reply)
+	}
+}
+
+func TestSessionDialer(t *testing.T) {
+	tests := []struct {
+		name           string
+		network        string
+		serverName     string
+		wantServerName string
+	}{
+		{name: "tcp", network: "", wantServerName: "127.0.0.1"},
+		{name: "tcp4 with server name", network: "tcp4", serverName: "mail.example.com", wantServerName: "mail.example.com"},
+		{name: "unix", network: "unix", wantServerName: "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l net.Listener
+			var err error
+			if tt.network == "unix" {
+				l, err = net.Listen("unix", filepath.Join(t.TempDir(), "smtp"))
+			} else {
+				l, err = net.Listen("tcp4", "127.0.0.1:0")
+			}
+			if err != nil {
+				t.Skipf("net.Listen() error = %v", err)
+			}
+			defer l.Close()
+			go serveQuit(l)
+			dialer := &recordDialer{}
+			d := &SessionDialer{Network: tt.network, Address: l.Addr().String(), ServerName: tt.serverName, Dialer: dialer}
+			c, err := d.Dial()
+			if err != nil {
+				t.Fatalf("SessionDialer.Dial() error = %v", err)
+			}
+			defer c.Close()
+			if dialer.address != l.Addr().String() {
+				t.Errorf("Dialer.Dial() address = %q, want %q", dialer.address, l.Addr().String())
+			}
+			if c.serverName != tt.wantServerName {
+				t.Errorf("Session server name = %q, want %q", c.serverName, tt.wantServerName)
+			}
+			if err := c.Quit(); err != nil {
+				t.Errorf("Session.Quit() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		status   string
+		wantErr  bool
+	}{
+		{name: "connected", status: "200 Connection established"},
+		{name: "authenticated", username: "user", status: "200 Connection established"},
+		{name: "refused", status: "407 Proxy Authentication Required", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("net.Listen() error = %v", err)
+			}
+			defer l.Close()
+			requests := make(chan *http.Request, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- req
+				// the greeting is sent together with the response
+				conn.Write([]byte("HTTP/1.1 " + tt.status + "\r\n\r\n220 hello\r\n"))
+				bufio.NewReader(conn).ReadString('\n')
+			}()
+			proxy := &HTTPProxy{Address: l.Addr().String(), Username: tt.username, Password: "secret"}
+			d := &SessionDialer{Address: "mail.example.com:25", Dialer: proxy}
+			c, err := d.DialContext(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SessionDialer.DialContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			req := <-requests
+			if req.Method != http.MethodConnect || req.Host != "mail.example.com:25" {
+				t.Errorf("proxy request = %v %v, want CONNECT mail.example.com:25", req.Method, req.Host)
+			}
+			if _, _, ok := req.BasicAuth(); ok {
+				t.Errorf("proxy request with Authorization header")
+			}
+			if got := req.Header.Get("Proxy-Authorization") != ""; got != (tt.username != "") {
+				t.Errorf("proxy request Proxy-Authorization = %v, want %v", got, tt.username != "")
+			}
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			if c.serverName != "mail.example.com" {
+				t.Errorf("Session server name = %q, want mail.example.com", c.serverName)
+			}
+		})
+	}
+}
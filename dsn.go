@@ -0,0 +1,109 @@
+package mandala
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDSNNotSupported is returned when the DSN parameters are strict and the server does not support DSN.
+var ErrDSNNotSupported = errors.New("smtp: server does not support DSN")
+
+// DSN contains the Delivery Status Notification parameters of a message (RFC 3461).
+// The parameters are sent only if the server advertises the DSN extension.
+type DSN struct {
+	Return     string                  `json:"ret"`        // "FULL" or "HDRS"
+	EnvelopeID string                  `json:"envid"`      // envelope identifier returned in the notifications
+	Notify     []string                `json:"notify"`     // "NEVER" or any of "SUCCESS", "FAILURE", "DELAY"
+	Recipients map[string]RecipientDSN `json:"recipients"` // per-recipient parameters keyed by address
+	Strict     bool                    `json:"strict"`     // fail if the server does not support DSN
+}
+
+// RecipientDSN contains the DSN parameters of a single recipient.
+type RecipientDSN struct {
+	Notify            []string `json:"notify"` // overrides DSN.Notify
+	OriginalRecipient string   `json:"orcpt"`  // original recipient address
+}
+
+// validate checks the DSN parameters.
+func (d *DSN) validate() error {
+	switch strings.ToUpper(d.Return) {
+	case "", "FULL", "HDRS":
+	default:
+		return fmt.Errorf("smtp: invalid DSN RET value %q", d.Return)
+	}
+	if err := validateNotify(d.Notify); err != nil {
+		return err
+	}
+	for _, r := range d.Recipients {
+		if err := validateNotify(r.Notify); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNotify checks the values of the NOTIFY parameter.
+func validateNotify(notify []string) error {
+	for _, n := range notify {
+		switch strings.ToUpper(n) {
+		case "SUCCESS", "FAILURE", "DELAY":
+		case "NEVER":
+			if len(notify) > 1 {
+				return errors.New("smtp: DSN NOTIFY=NEVER can not be combined with other values")
+			}
+		default:
+			return fmt.Errorf("smtp: invalid DSN NOTIFY value %q", n)
+		}
+	}
+	return nil
+}
+
+// mailParams returns the RET and ENVID parameters of MAIL FROM.
+func (d *DSN) mailParams() string {
+	if d == nil {
+		return ""
+	}
+	var params string
+	if d.Return != "" {
+		params += " RET=" + strings.ToUpper(d.Return)
+	}
+	if d.EnvelopeID != "" {
+		params += " ENVID=" + xtext(d.EnvelopeID)
+	}
+	return params
+}
+
+// rcptParams returns the NOTIFY and ORCPT parameters of RCPT TO for the address.
+func (d *DSN) rcptParams(addr string) string {
+	if d == nil {
+		return ""
+	}
+	notify := d.Notify
+	r, ok := d.Recipients[addr]
+	if ok && len(r.Notify) > 0 {
+		notify = r.Notify
+	}
+	var params string
+	if len(notify) > 0 {
+		params += " NOTIFY=" + strings.ToUpper(strings.Join(notify, ","))
+	}
+	if r.OriginalRecipient != "" {
+		params += " ORCPT=rfc822;" + xtext(r.OriginalRecipient)
+	}
+	return params
+}
+
+// xtext encodes a parameter value as xtext (RFC 3461 section 4).
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
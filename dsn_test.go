@@ -0,0 +1,52 @@
+package mandala
+
+import (
+	"testing"
+)
+
+func TestXtext(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "plain", s: "abc@test.com", want: "abc@test.com"},
+		{name: "special", s: "a+b=c d", want: "a+2Bb+3Dc+20d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := xtext(tt.s); got != tt.want {
+				t.Errorf("xtext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSession_MailAndRcpt_DSN(t *testing.T) {
+	dsn := &DSN{Return: "hdrs", EnvelopeID: "id+1", Notify: []string{"failure", "delay"},
+		Recipients: map[string]RecipientDSN{"to2@test.com": RecipientDSN{Notify: []string{"NEVER"}, OriginalRecipient: "orig@test.com"}}}
+	tests := []struct {
+		name     string
+		dsn      *DSN
+		server   []string
+		wantErr  error
+		snippets []string
+	}{
+		{name: "DSN supported", dsn: dsn, server: []string{"220 hello", "250-fake.host", "250 DSN", "250 ok", "250 ok", "250 ok"},
+			snippets: []string{"MAIL FROM:<from@test.com> RET=HDRS ENVID=id+2B1\r\n", "RCPT TO:<to1@test.com> NOTIFY=FAILURE,DELAY\r\n", "RCPT TO:<to2@test.com> NOTIFY=NEVER ORCPT=rfc822;orig@test.com\r\n"}},
+		{name: "DSN not supported", dsn: dsn, server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "250 ok"},
+			snippets: []string{"MAIL FROM:<from@test.com>\r\n", "RCPT TO:<to1@test.com>\r\n"}},
+		{name: "DSN strict", dsn: &DSN{Notify: []string{"SUCCESS"}, Strict: true}, server: []string{"220 hello", "250 fake.host"}, wantErr: ErrDSNNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}, EmailAddress{Address: "to2@test.com"}}, "Hello", "", "Hello world!")
+			msg.DSN = tt.dsn
+			c, cmds := newFakeSession(t, tt.server...)
+			if err := c.MailAndRcpt(msg); err != tt.wantErr {
+				t.Errorf("Session.MailAndRcpt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			FindSnippets(t, cmds.String(), tt.snippets)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package mandala
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// SMTPError is an error reply of the server.
+type SMTPError struct {
+	// Command is the command or the phase that failed: "GREETING", "EHLO",
+	// "HELO", "STARTTLS", "AUTH", "MAIL", "RCPT", "DATA", "BDAT", "END-OF-DATA"...
+	Command string
+	// Code is the basic reply code, as in 550.
+	Code int
+	// EnhancedCode is the RFC 3463 enhanced status code, as in "5.1.1".
+	// It is parsed only if the server advertises ENHANCEDSTATUSCODES.
+	EnhancedCode string
+	// Message is the reply text without the enhanced status code.
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "smtp: %s failed: %03d", e.Command, e.Code)
+	if e.EnhancedCode != "" {
+		b.WriteString(" " + e.EnhancedCode)
+	}
+	if e.Message != "" {
+		b.WriteString(" " + e.Message)
+	}
+	return b.String()
+}
+
+// Unwrap returns the error as a *textproto.Error.
+func (e *SMTPError) Unwrap() error {
+	msg := e.Message
+	if e.EnhancedCode != "" {
+		msg = strings.TrimSpace(e.EnhancedCode + " " + msg)
+	}
+	return &textproto.Error{Code: e.Code, Msg: msg}
+}
+
+// enhancedClass returns the class and the subject of the enhanced status code
+// (as in "5" and "1" for "5.1.1").
+func (e *SMTPError) enhancedClass() (string, string) {
+	fields := strings.SplitN(e.EnhancedCode, ".", 3)
+	if len(fields) != 3 {
+		return "", ""
+	}
+	return fields[0], fields[1]
+}
+
+// replyError converts a *textproto.Error of a command into a *SMTPError.
+// The other errors are returned unchanged.
+func (c *Session) replyError(command string, err error) error {
+	terr, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+	e := &SMTPError{Command: command, Code: terr.Code, Message: terr.Msg}
+	if _, ok := c.ext["ENHANCEDSTATUSCODES"]; ok {
+		e.EnhancedCode, e.Message = parseEnhancedCode(terr.Msg)
+	}
+	return e
+}
+
+// commandName returns the name of the command line, as in "MAIL" for "MAIL FROM:<a@b.c>".
+func commandName(line string) string {
+	return strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+}
+
+// parseEnhancedCode splits a reply text in the RFC 3463 enhanced status code
+// and the rest of the text. The code is empty if the text does not start with it.
+func parseEnhancedCode(msg string) (string, string) {
+	parts := strings.SplitN(msg, " ", 2)
+	fields := strings.Split(parts[0], ".")
+	if len(fields) != 3 || len(fields[0]) != 1 || strings.IndexAny(fields[0], "245") != 0 {
+		return "", msg
+	}
+	for _, f := range fields[1:] {
+		if len(f) == 0 || len(f) > 3 || strings.Trim(f, "0123456789") != "" {
+			return "", msg
+		}
+	}
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// IsPermanent returns true if the error is permanent, and false otherwise.
+// If it can't tell, it returns false.
+func IsPermanent(err error) bool {
+	var terr *textproto.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	// Error codes 5yz are permanent.
+	// https://tools.ietf.org/html/rfc5321#section-4.2.1
+	if terr.Code >= 500 && terr.Code < 600 {
+		return true
+	}
+	return false
+}
+
+// IsTemporary returns true if the error is a 4xx reply of the server.
+func IsTemporary(err error) bool {
+	var terr *textproto.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	// Error codes 4yz are transient.
+	// https://tools.ietf.org/html/rfc5321#section-4.2.1
+	return terr.Code >= 400 && terr.Code < 500
+}
+
+// IsTransient returns true if the error is transient and the sending can be
+// retried: 4xx replies and network errors. A *PartialDeliveryError is
+// transient if the delivery to some of the failed recipients can be retried.
+func IsTransient(err error) bool {
+	var derr *PartialDeliveryError
+	if errors.As(err, &derr) {
+		return len(derr.Retry()) > 0
+	}
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		return IsTemporary(err)
+	}
+	var nerr net.Error
+	var perr textproto.ProtocolError
+	return errors.As(err, &nerr) || errors.As(err, &perr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsAuthFailure returns true if the error is an authentication failure.
+func IsAuthFailure(err error) bool {
+	var oerr *OAuthError
+	if errors.As(err, &oerr) {
+		return true
+	}
+	var serr *SMTPError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	// 530 Authentication required, 534 mechanism too weak,
+	// 535 credentials invalid, 538 encryption required, 454 temporary failure
+	switch serr.Code {
+	case 530, 534, 535, 538:
+		return true
+	case 454:
+		return serr.Command == "AUTH"
+	}
+	switch serr.EnhancedCode {
+	case "5.7.8", "5.7.9", "5.7.11", "4.7.12":
+		return true
+	case "5.7.0", "4.7.0":
+		// generic security status, an authentication failure only on AUTH
+		return serr.Command == "AUTH"
+	}
+	return false
+}
+
+// IsMailboxUnavailable returns true if the error shows that the mailbox of
+// the recipient does not exist or can not receive messages.
+func IsMailboxUnavailable(err error) bool {
+	var serr *SMTPError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	if _, subject := serr.enhancedClass(); subject != "" {
+		// X.1.X addressing status, X.2.X mailbox status
+		return subject == "1" || subject == "2"
+	}
+	switch serr.Code {
+	case 450, 550, 551, 553:
+		return serr.Command == "RCPT"
+	}
+	return false
+}
+
+// IsPolicyRejection returns true if the message has been rejected for a
+// security or policy reason, as spam or reputation filtering.
+func IsPolicyRejection(err error) bool {
+	var serr *SMTPError
+	if !errors.As(err, &serr) || IsAuthFailure(err) {
+		return false
+	}
+	if _, subject := serr.enhancedClass(); subject != "" {
+		// X.7.X security or policy status
+		return subject == "7"
+	}
+	return serr.Code == 554 && serr.Command != "GREETING"
+}
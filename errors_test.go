@@ -0,0 +1,106 @@
+package mandala
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"testing"
+)
+
+func TestParseEnhancedCode(t *testing.T) {
+	tests := []struct {
+		msg          string
+		wantEnhanced string
+		wantText     string
+	}{
+		{msg: "5.1.1 no such user", wantEnhanced: "5.1.1", wantText: "no such user"},
+		{msg: "2.0.0", wantEnhanced: "2.0.0", wantText: ""},
+		{msg: "ok", wantEnhanced: "", wantText: "ok"},
+		{msg: "1.2.3 version", wantEnhanced: "", wantText: "1.2.3 version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			enhanced, text := parseEnhancedCode(tt.msg)
+			if enhanced != tt.wantEnhanced || text != tt.wantText {
+				t.Errorf("parseEnhancedCode() = %q, %q, want %q, %q", enhanced, text, tt.wantEnhanced, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestSMTPError_Classify(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		permanent bool
+		temporary bool
+		auth      bool
+		mailbox   bool
+		policy    bool
+	}{
+		{name: "unknown user", err: &SMTPError{Command: "RCPT", Code: 550, EnhancedCode: "5.1.1", Message: "no such user"}, permanent: true, mailbox: true},
+		{name: "mailbox full", err: &SMTPError{Command: "RCPT", Code: 452, EnhancedCode: "4.2.2", Message: "mailbox full"}, temporary: true, mailbox: true},
+		{name: "unknown user no enhanced", err: &SMTPError{Command: "RCPT", Code: 550, Message: "no such user"}, permanent: true, mailbox: true},
+		{name: "bad credentials", err: &SMTPError{Command: "AUTH", Code: 535, EnhancedCode: "5.7.8", Message: "bad credentials"}, permanent: true, auth: true},
+		{name: "auth required", err: &SMTPError{Command: "MAIL", Code: 530, Message: "authentication required"}, permanent: true, auth: true},
+		{name: "auth required enhanced", err: &SMTPError{Command: "MAIL", Code: 530, EnhancedCode: "5.7.0", Message: "Authentication required"}, permanent: true, auth: true},
+		{name: "security policy", err: &SMTPError{Command: "MAIL", Code: 550, EnhancedCode: "5.7.0", Message: "sender rejected"}, permanent: true, policy: true},
+		{name: "rejected recipient", err: &RcptError{Recipient: "to@test.com", Err: &SMTPError{Command: "RCPT", Code: 550, EnhancedCode: "5.1.1", Message: "no such user"}}, permanent: true, mailbox: true},
+		{name: "spam", err: &SMTPError{Command: "END-OF-DATA", Code: 550, EnhancedCode: "5.7.1", Message: "spam"}, permanent: true, policy: true},
+		{name: "rejected no enhanced", err: &SMTPError{Command: "END-OF-DATA", Code: 554, Message: "rejected"}, permanent: true, policy: true},
+		{name: "greylisting", err: &SMTPError{Command: "RCPT", Code: 451, EnhancedCode: "4.7.1", Message: "try later"}, temporary: true, policy: true},
+		{name: "oauth", err: &OAuthError{Status: "401"}, auth: true},
+		{name: "textproto", err: &textproto.Error{Code: 421, Msg: "closing"}, temporary: true},
+		{name: "io", err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.permanent {
+				t.Errorf("IsPermanent() = %v, want %v", got, tt.permanent)
+			}
+			if got := IsTemporary(tt.err); got != tt.temporary {
+				t.Errorf("IsTemporary() = %v, want %v", got, tt.temporary)
+			}
+			if got := IsAuthFailure(tt.err); got != tt.auth {
+				t.Errorf("IsAuthFailure() = %v, want %v", got, tt.auth)
+			}
+			if got := IsMailboxUnavailable(tt.err); got != tt.mailbox {
+				t.Errorf("IsMailboxUnavailable() = %v, want %v", got, tt.mailbox)
+			}
+			if got := IsPolicyRejection(tt.err); got != tt.policy {
+				t.Errorf("IsPolicyRejection() = %v, want %v", got, tt.policy)
+			}
+		})
+	}
+}
+
+func TestSession_SMTPError(t *testing.T) {
+	tests := []struct {
+		name         string
+		server       []string
+		wantCommand  string
+		wantEnhanced string
+		wantMessage  string
+	}{
+		{name: "mail with enhanced codes", server: []string{"220 hello", "250-fake.host", "250 ENHANCEDSTATUSCODES", "553 5.1.8 bad sender"},
+			wantCommand: "MAIL", wantEnhanced: "5.1.8", wantMessage: "bad sender"},
+		{name: "mail without enhanced codes", server: []string{"220 hello", "250 fake.host", "553 5.1.8 bad sender"},
+			wantCommand: "MAIL", wantMessage: "5.1.8 bad sender"},
+		{name: "end of data", server: []string{"220 hello", "250-fake.host", "250 ENHANCEDSTATUSCODES", "250 ok", "250 ok", "354 go", "554 5.7.1 spam"},
+			wantCommand: "END-OF-DATA", wantEnhanced: "5.7.1", wantMessage: "spam"},
+	}
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeSession(t, tt.server...)
+			err := c.SendSingleMessage(msg)
+			var serr *SMTPError
+			if !errors.As(err, &serr) {
+				t.Fatalf("Session.SendSingleMessage() error = %v, want *SMTPError", err)
+			}
+			if serr.Command != tt.wantCommand || serr.EnhancedCode != tt.wantEnhanced || serr.Message != tt.wantMessage {
+				t.Errorf("Session.SendSingleMessage() error = %+v, want %v %q %q", serr, tt.wantCommand, tt.wantEnhanced, tt.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package mandala
+
+import (
+	"fmt"
+	"net/smtp"
+)
+
+// NewLMTPSession returns a new client Session in LMTP mode connected to an
+// LMTP server. The network is "tcp", as in NewLMTPSession("tcp", "mail.example.com:24", nil),
+// or "unix", as in NewLMTPSession("unix", "/var/run/dovecot/lmtp", nil).
+func NewLMTPSession(network, address string, a smtp.Auth) (*Session, error) {
+	d := &SessionDialer{Network: network, Address: address, Auth: a, LMTP: true}
+	return d.Dial()
+}
+
+// PartialDeliveryError is returned when the message has been delivered only
+// to some of the recipients, as it happens in LMTP mode when the server
+// accepts the message for some mailboxes only.
+// It is transient if the delivery to at least one recipient can be retried.
+type PartialDeliveryError struct {
+	Delivered []string     // recipients the message has been delivered to
+	Failed    []*RcptError // recipients the message has not been delivered to
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return fmt.Sprintf("message delivered to %d of %d recipients: %v", len(e.Delivered),
+		len(e.Delivered)+len(e.Failed), e.Failed[0])
+}
+
+// Unwrap returns the failures of the recipients.
+func (e *PartialDeliveryError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f
+	}
+	return errs
+}
+
+// Retry returns the recipients whose delivery can be retried: the ones that
+// failed with a transient error.
+func (e *PartialDeliveryError) Retry() []string {
+	addrs := make([]string, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		if IsTransient(f) {
+			addrs = append(addrs, f.Recipient)
+		}
+	}
+	return addrs
+}
+
+// retried returns the outcome of the message after the recipients returned by
+// Retry have been sent it again, failing with err.
+func (e *PartialDeliveryError) retried(err error) error {
+	retry := make(map[string]bool)
+	for _, addr := range e.Retry() {
+		retry[addr] = true
+	}
+	res := &PartialDeliveryError{Delivered: append([]string{}, e.Delivered...)}
+	for _, f := range e.Failed {
+		if !retry[f.Recipient] {
+			res.Failed = append(res.Failed, f)
+		}
+	}
+	perr, partial := err.(*PartialDeliveryError)
+	switch {
+	case err == nil:
+		for _, f := range e.Failed {
+			if retry[f.Recipient] {
+				res.Delivered = append(res.Delivered, f.Recipient)
+			}
+		}
+	case partial:
+		res.Delivered = append(res.Delivered, perr.Delivered...)
+		res.Failed = append(res.Failed, perr.Failed...)
+	default:
+		for _, f := range e.Failed {
+			if retry[f.Recipient] {
+				res.Failed = append(res.Failed, &RcptError{Recipient: f.Recipient, Err: err})
+			}
+		}
+	}
+	if len(res.Failed) == 0 {
+		return nil
+	}
+	return res
+}
+
+// readDeliveries reads the LMTP replies to the message, one for every accepted
+// recipient. If the message has not been delivered to any recipient it returns
+// the *RcptError of the first one, if it has been delivered to some of them it
+// returns a *PartialDeliveryError.
+// If PartialDelivery is true it fails only if the message has not been delivered
+// to any recipient.
+func (c *Session) readDeliveries() error {
+	c.delivered = c.delivered[:0]
+	var delivered []string
+	var failed []*RcptError
+	for _, addr := range c.accepted {
+		code, msg, err := c.Text.ReadResponse(250)
+		err = c.replyError("END-OF-DATA", err)
+		serr, ok := err.(*SMTPError)
+		if err != nil && !ok {
+			return err
+		}
+		c.delivered = append(c.delivered, c.rcptResult(addr, code, msg, err))
+		if ok {
+			failed = append(failed, &RcptError{Recipient: addr, Err: serr})
+		} else {
+			delivered = append(delivered, addr)
+		}
+	}
+	switch {
+	case len(failed) == 0 || c.PartialDelivery && len(delivered) > 0:
+		return nil
+	case len(delivered) == 0:
+		return failed[0]
+	}
+	return &PartialDeliveryError{Delivered: delivered, Failed: failed}
+}
+
+// mergeDeliveries replaces the results of the accepted recipients with the
+// outcome of the LMTP deliveries.
+func mergeDeliveries(results, delivered []RcptResult) []RcptResult {
+	i := 0
+	for j, r := range results {
+		if r.Accepted() && i < len(delivered) {
+			results[j] = delivered[i]
+			i++
+		}
+	}
+	return results
+}
@@ -0,0 +1,107 @@
+package mandala
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+)
+
+func TestSession_LMTP(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}, EmailAddress{Address: "to2@test.com"}, EmailAddress{Address: "to3@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name         string
+		partial      bool
+		server       []string
+		wantErr      string // first recipient not delivered
+		wantPartial  bool
+		wantAccepted []bool
+		snippets     []string
+	}{
+		{name: "delivered", server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "250 ok", "250 ok", "354 go", "250 ok", "250 ok", "250 ok"},
+			wantAccepted: []bool{true, true, true}, snippets: []string{"LHLO localhost\r\n", "\r\n.\r\n"}},
+		{name: "mailbox full", server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "250 ok", "250 ok", "354 go", "250 ok", "452 mailbox full", "250 ok"},
+			wantErr: "to2@test.com", wantPartial: true, wantAccepted: []bool{true, false, true}},
+		{name: "not delivered", server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "250 ok", "250 ok", "354 go", "452 mailbox full", "452 mailbox full", "452 mailbox full"},
+			wantErr: "to1@test.com", wantAccepted: []bool{false, false, false}},
+		{name: "partial delivery", partial: true, server: []string{"220 hello", "250 fake.host", "250 ok", "550 no such user", "250 ok", "250 ok", "354 go", "452 mailbox full", "250 ok"},
+			wantAccepted: []bool{false, false, true}},
+		{name: "pipelined", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "250 ok", "250 ok", "250 ok", "354 go", "250 ok", "250 ok", "250 ok"},
+			wantAccepted: []bool{true, true, true}},
+		{name: "bdat", server: []string{"220 hello", "250-fake.host", "250 CHUNKING", "250 ok", "250 ok", "250 ok", "250 ok", "250 ok", "550 quota", "250 ok"},
+			wantErr: "to2@test.com", wantPartial: true, wantAccepted: []bool{true, false, true}, snippets: []string{" LAST\r\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cmds := newFakeSession(t, tt.server...)
+			c.LMTP = true
+			c.PartialDelivery = tt.partial
+			results, err := c.SendSingleMessageResults(msg)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Session.SendSingleMessageResults() error = %v", err)
+			}
+			if tt.wantErr != "" {
+				var rerr *RcptError
+				if !errors.As(err, &rerr) || rerr.Recipient != tt.wantErr {
+					t.Fatalf("Session.SendSingleMessageResults() error = %v, want failed %v", err, tt.wantErr)
+				}
+				var perr *PartialDeliveryError
+				if errors.As(err, &perr) != tt.wantPartial {
+					t.Errorf("Session.SendSingleMessageResults() error = %v, want partial %v", err, tt.wantPartial)
+				}
+			}
+			if len(results) != len(tt.wantAccepted) {
+				t.Fatalf("Session.SendSingleMessageResults() returned %d results, want %d", len(results), len(tt.wantAccepted))
+			}
+			for i, r := range results {
+				if r.Accepted() != tt.wantAccepted[i] {
+					t.Errorf("RcptResult %v = %+v, want accepted %v", r.Address, r, tt.wantAccepted[i])
+				}
+			}
+			FindSnippets(t, cmds.String(), tt.snippets)
+		})
+	}
+}
+
+func TestNewLMTPSession_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lmtp")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 lmtp ready")
+		for _, reply := range []string{"250 localhost", "250 ok", "250 ok", "354 go"} {
+			text.ReadLine()
+			text.PrintfLine(reply)
+		}
+		text.ReadDotLines()
+		text.PrintfLine("250 2.0.0 delivered")
+		text.ReadLine()
+		text.PrintfLine("221 bye")
+	}()
+	c, err := NewLMTPSession("unix", path, nil)
+	if err != nil {
+		t.Fatalf("NewLMTPSession() error = %v", err)
+	}
+	defer c.Close()
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	results, err := c.SendSingleMessageResults(msg)
+	if err != nil {
+		t.Fatalf("Session.SendSingleMessageResults() error = %v", err)
+	}
+	if len(results) != 1 || !results[0].Accepted() {
+		t.Errorf("Session.SendSingleMessageResults() = %+v, want delivered", results)
+	}
+	if err := c.Quit(); err != nil {
+		t.Errorf("Session.Quit() error = %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Package mandalatest provides a fake SMTP server for the tests of mandala and
+of the applications using it.
+
+The server listens on a loopback address, advertises the configured extensions
+and records the envelope and the raw payload of every message it accepts:
+
+	s := mandalatest.NewUnstartedServer("8BITMIME", "PIPELINING", "SMTPUTF8")
+	s.Users = map[string]string{"user": "secret"}
+	s.Script("RCPT", "550 5.1.1 no such user")
+	s.StartTLS()
+	defer s.Close()
+	// send using s.Addr and s.ClientTLSConfig()
+	for _, msg := range s.Messages() {
+		...
+	}
+*/
+package mandalatest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Server is a fake SMTP server listening on a loopback address.
+type Server struct {
+	// Addr is the address of the server, as in "127.0.0.1:52876".
+	Addr string
+	// Hostname is the name sent in the greeting and in the EHLO reply.
+	Hostname string
+	// Extensions are the EHLO keywords advertised by the server, as in
+	// "PIPELINING" or "DSN". BDAT is accepted when "CHUNKING" is advertised.
+	// STARTTLS, AUTH and SIZE are advertised according to TLS, Users and MaxSize.
+	Extensions []string
+	// MaxSize is the maximum size of the messages, if greater than 0 the
+	// server advertises SIZE and rejects the larger messages.
+	MaxSize int64
+	// Users are the usernames and the passwords of the clients. If not empty
+	// the server advertises AUTH PLAIN LOGIN and requires the authentication
+	// before MAIL FROM.
+	Users map[string]string
+	// TLS is the configuration of STARTTLS, the server advertises STARTTLS if
+	// it is not nil. StartTLS sets it using a self-signed certificate.
+	TLS *tls.Config
+
+	l           net.Listener
+	certificate *x509.Certificate
+	wg          sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	scripts  map[string][]string
+	commands []string
+	messages []Message
+	closed   bool
+}
+
+// Message is a message accepted by the server.
+type Message struct {
+	Helo       string      // name sent with HELO or EHLO
+	TLS        bool        // the session was encrypted with STARTTLS
+	Username   string      // authenticated user, empty if the client did not authenticate
+	From       string      // reverse path of MAIL FROM
+	FromParams []string    // parameters of MAIL FROM, as in "BODY=8BITMIME"
+	To         []Recipient // recipients accepted with RCPT TO
+	Data       []byte      // raw payload of DATA or BDAT, with the leading dots unstuffed
+}
+
+// Recipient is a recipient accepted with RCPT TO.
+type Recipient struct {
+	Address string
+	Params  []string // parameters of RCPT TO, as in "NOTIFY=FAILURE"
+}
+
+// NewServer starts and returns a new Server advertising the extensions.
+// The caller should call Close when finished, to shut it down.
+func NewServer(extensions ...string) *Server {
+	s := NewUnstartedServer(extensions...)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server advertising the extensions but doesn't start it.
+// After changing its configuration, the caller should call Start or StartTLS.
+func NewUnstartedServer(extensions ...string) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic(fmt.Sprintf("mandalatest: failed to listen on a port: %v", err))
+		}
+	}
+	return &Server{
+		Addr:       l.Addr().String(),
+		Hostname:   "mandalatest.local",
+		Extensions: extensions,
+		l:          l,
+		conns:      make(map[net.Conn]bool),
+		scripts:    make(map[string][]string),
+	}
+}
+
+// Start starts the server.
+func (s *Server) Start() {
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// StartTLS generates a self-signed certificate for the loopback addresses and
+// starts the server advertising STARTTLS. The clients can trust the
+// certificate using ClientTLSConfig.
+func (s *Server) StartTLS() {
+	cert, err := newCertificate()
+	if err != nil {
+		panic(fmt.Sprintf("mandalatest: failed to generate the certificate: %v", err))
+	}
+	s.certificate = cert.Leaf
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.Start()
+}
+
+// Certificate returns the certificate of the server, nil if it was not started with StartTLS.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// ClientTLSConfig returns a TLS configuration trusting the certificate of the server.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	if s.certificate != nil {
+		pool.AddCert(s.certificate)
+	}
+	return &tls.Config{RootCAs: pool}
+}
+
+// Close closes the listener and the open connections, and waits for the sessions to end.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.l.Close()
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Script sets the replies to the next commands with the verb, as in
+//
+//	s.Script("RCPT", "250 ok", "550 5.1.1 no such user")
+//
+// The verb "GREETING" scripts the greeting and "END-OF-DATA" the reply to the
+// message payload. The server closes the connection after a 421 reply.
+// The commands rejected as not valid do not use the scripted replies. When
+// the scripted replies are used up the server replies normally.
+func (s *Server) Script(verb string, replies ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	verb = strings.ToUpper(verb)
+	s.scripts[verb] = append(s.scripts[verb], replies...)
+}
+
+// Commands returns the command lines received by the server, excluding the
+// authentication exchanges and the message payloads.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Messages returns the messages accepted by the server.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			newSession(s, conn).serve()
+			conn.Close()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// reply returns the scripted reply to the verb, or def if there is none.
+func (s *Server) reply(verb, def string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies := s.scripts[verb]
+	if len(replies) == 0 {
+		return def
+	}
+	s.scripts[verb] = replies[1:]
+	return replies[0]
+}
+
+func (s *Server) record(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, line)
+}
+
+func (s *Server) accept(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+}
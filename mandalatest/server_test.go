@@ -0,0 +1,147 @@
+package mandalatest
+
+import (
+	"errors"
+	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+// send sends a message to the server with net/smtp.
+func send(s *Server, a smtp.Auth, to ...string) error {
+	c, err := smtp.Dial(s.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if s.TLS != nil {
+		config := s.ClientTLSConfig()
+		config.ServerName = "127.0.0.1"
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail("from@test.com"); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("Subject: Hello\r\n\r\n.Hello world!\r\n")); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      bool
+		users    map[string]string
+		auth     smtp.Auth
+		scripts  map[string][]string
+		wantCode int
+		wantFrom []string
+		wantTo   []Recipient
+		wantTLS  bool
+		wantUser string
+	}{
+		{name: "sent", wantFrom: []string{"BODY=8BITMIME"}, wantTo: []Recipient{{Address: "to@test.com"}}},
+		{name: "starttls", tls: true, wantFrom: []string{"BODY=8BITMIME"}, wantTo: []Recipient{{Address: "to@test.com"}}, wantTLS: true},
+		{name: "authenticated", users: map[string]string{"user": "secret"}, auth: smtp.PlainAuth("", "user", "secret", "127.0.0.1"),
+			wantFrom: []string{"BODY=8BITMIME"}, wantTo: []Recipient{{Address: "to@test.com"}}, wantUser: "user"},
+		{name: "wrong password", users: map[string]string{"user": "secret"}, auth: smtp.PlainAuth("", "user", "wrong", "127.0.0.1"),
+			wantCode: 535},
+		{name: "authentication required", users: map[string]string{"user": "secret"}, wantCode: 530},
+		{name: "rejected recipient", scripts: map[string][]string{"RCPT": {"550 5.1.1 no such user"}}, wantCode: 550},
+		{name: "rejected message", scripts: map[string][]string{"END-OF-DATA": {"554 5.7.1 spam"}}, wantCode: 554},
+		{name: "service not available", scripts: map[string][]string{"MAIL": {"421 4.3.2 closing"}}, wantCode: 421},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewUnstartedServer("8BITMIME", "PIPELINING")
+			s.Users = tt.users
+			for verb, replies := range tt.scripts {
+				s.Script(verb, replies...)
+			}
+			if tt.tls {
+				s.StartTLS()
+			} else {
+				s.Start()
+			}
+			defer s.Close()
+			err := send(s, tt.auth, "to@test.com")
+			if tt.wantCode != 0 {
+				var terr *textproto.Error
+				if !errors.As(err, &terr) || terr.Code != tt.wantCode {
+					t.Fatalf("send() error = %v, want code %d", err, tt.wantCode)
+				}
+				if messages := s.Messages(); len(messages) != 0 {
+					t.Errorf("Server.Messages() = %d messages, want none", len(messages))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send() error = %v", err)
+			}
+			messages := s.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("Server.Messages() = %d messages, want 1", len(messages))
+			}
+			msg := messages[0]
+			if msg.From != "from@test.com" || !reflect.DeepEqual(msg.FromParams, tt.wantFrom) {
+				t.Errorf("Message.From = %q %v, want from@test.com %v", msg.From, msg.FromParams, tt.wantFrom)
+			}
+			if !reflect.DeepEqual(msg.To, tt.wantTo) {
+				t.Errorf("Message.To = %v, want %v", msg.To, tt.wantTo)
+			}
+			if msg.TLS != tt.wantTLS || msg.Username != tt.wantUser {
+				t.Errorf("Message TLS = %v, Username = %q, want %v, %q", msg.TLS, msg.Username, tt.wantTLS, tt.wantUser)
+			}
+			if want := "Subject: Hello\r\n\r\n.Hello world!\r\n"; string(msg.Data) != want {
+				t.Errorf("Message.Data = %q, want %q", msg.Data, want)
+			}
+		})
+	}
+}
+
+func TestServer_Extensions(t *testing.T) {
+	s := NewUnstartedServer("SMTPUTF8", "DSN")
+	s.MaxSize = 1024
+	s.Users = map[string]string{"user": "secret"}
+	s.StartTLS()
+	defer s.Close()
+	c, err := smtp.Dial(s.Addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer c.Close()
+	for _, tt := range []struct {
+		ext, param string
+	}{{"SMTPUTF8", ""}, {"DSN", ""}, {"SIZE", "1024"}, {"AUTH", "PLAIN LOGIN"}, {"STARTTLS", ""}} {
+		if ok, param := c.Extension(tt.ext); !ok || param != tt.param {
+			t.Errorf("Client.Extension(%q) = %v, %q, want true, %q", tt.ext, ok, param, tt.param)
+		}
+	}
+	if ok, _ := c.Extension("CHUNKING"); ok {
+		t.Errorf("Client.Extension(CHUNKING) = true, want false")
+	}
+	if got := s.Commands(); len(got) != 1 || got[0] != "EHLO localhost" {
+		t.Errorf("Server.Commands() = %q, want [EHLO localhost]", got)
+	}
+}
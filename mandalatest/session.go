@@ -0,0 +1,387 @@
+package mandalatest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// errClosed is returned by the handlers when the connection must be closed.
+var errClosed = errors.New("mandalatest: connection closed")
+
+// errCanceled is returned by challenge when the client cancels the authentication.
+var errCanceled = errors.New("mandalatest: authentication canceled")
+
+// session is the state of a client connection.
+type session struct {
+	s        *Server
+	conn     net.Conn
+	text     *textproto.Conn
+	tls      bool
+	helo     string
+	ehlo     bool
+	username string
+	msg      *Message // current transaction, nil before MAIL FROM
+	data     bytes.Buffer
+}
+
+func newSession(s *Server, conn net.Conn) *session {
+	return &session{s: s, conn: conn, text: textproto.NewConn(conn)}
+}
+
+func (c *session) serve() {
+	if err := c.reply("GREETING", "220 "+c.s.Hostname+" ESMTP mandalatest"); err != nil {
+		return
+	}
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return
+		}
+		c.s.record(line)
+		verb, arg, _ := strings.Cut(line, " ")
+		if err := c.handle(strings.ToUpper(verb), arg); err != nil {
+			return
+		}
+	}
+}
+
+// reply sends the scripted reply to the verb, or def if there is none.
+func (c *session) reply(verb, def string) error {
+	_, err := c.write(c.s.reply(verb, def))
+	return err
+}
+
+// fail sends the reply to a command that is not valid, the scripts are not used.
+func (c *session) fail(reply string) error {
+	_, err := c.write(reply)
+	return err
+}
+
+// write sends the reply and reports whether it is positive. It returns
+// errClosed after a 421 reply.
+func (c *session) write(reply string) (bool, error) {
+	if err := c.text.PrintfLine("%s", reply); err != nil {
+		return false, err
+	}
+	if strings.HasPrefix(reply, "421") {
+		return false, errClosed
+	}
+	return strings.HasPrefix(reply, "2") || strings.HasPrefix(reply, "3"), nil
+}
+
+func (c *session) handle(verb, arg string) error {
+	switch verb {
+	case "EHLO", "HELO":
+		return c.hello(verb, arg)
+	case "STARTTLS":
+		return c.startTLS()
+	case "AUTH":
+		return c.auth(arg)
+	case "MAIL":
+		return c.mail(arg)
+	case "RCPT":
+		return c.rcpt(arg)
+	case "DATA":
+		return c.dataCmd()
+	case "BDAT":
+		return c.bdat(arg)
+	case "RSET":
+		c.msg = nil
+		return c.reply(verb, "250 2.0.0 ok")
+	case "NOOP":
+		return c.reply(verb, "250 2.0.0 ok")
+	case "VRFY":
+		return c.reply(verb, "252 2.1.5 cannot verify the user")
+	case "QUIT":
+		c.reply(verb, "221 2.0.0 bye")
+		return errClosed
+	default:
+		return c.reply(verb, "502 5.5.2 command not implemented")
+	}
+}
+
+func (c *session) hello(verb, arg string) error {
+	if arg == "" {
+		return c.fail("501 5.5.4 syntax: " + verb + " hostname")
+	}
+	reply := "250 " + c.s.Hostname
+	if verb == "EHLO" {
+		lines := append([]string{c.s.Hostname}, c.extensions()...)
+		for i := range lines[:len(lines)-1] {
+			lines[i] = "250-" + lines[i]
+		}
+		lines[len(lines)-1] = "250 " + lines[len(lines)-1]
+		reply = strings.Join(lines, "\r\n")
+	}
+	ok, err := c.write(c.s.reply(verb, reply))
+	if ok {
+		c.helo, c.ehlo, c.msg = arg, verb == "EHLO", nil
+	}
+	return err
+}
+
+// extensions returns the EHLO keywords of the session.
+func (c *session) extensions() []string {
+	ext := append([]string(nil), c.s.Extensions...)
+	if c.s.TLS != nil && !c.tls {
+		ext = append(ext, "STARTTLS")
+	}
+	if len(c.s.Users) > 0 {
+		ext = append(ext, "AUTH PLAIN LOGIN")
+	}
+	if c.s.MaxSize > 0 {
+		ext = append(ext, fmt.Sprintf("SIZE %d", c.s.MaxSize))
+	}
+	return ext
+}
+
+// advertised reports whether the session advertises the extension.
+func (c *session) advertised(name string) bool {
+	for _, ext := range c.extensions() {
+		if keyword, _, _ := strings.Cut(ext, " "); strings.EqualFold(keyword, name) {
+			return c.ehlo
+		}
+	}
+	return false
+}
+
+func (c *session) startTLS() error {
+	if c.tls || !c.advertised("STARTTLS") {
+		return c.fail("503 5.5.1 STARTTLS not available")
+	}
+	if ok, err := c.write(c.s.reply("STARTTLS", "220 2.0.0 ready to start TLS")); !ok || err != nil {
+		return err
+	}
+	conn := tls.Server(c.conn, c.s.TLS)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	// the session is reset after the handshake (RFC 3207 section 4.2)
+	c.conn, c.text, c.tls = conn, textproto.NewConn(conn), true
+	c.helo, c.ehlo, c.username, c.msg = "", false, "", nil
+	return nil
+}
+
+func (c *session) auth(arg string) error {
+	err := c.authenticate(arg)
+	if err == errCanceled {
+		return nil
+	}
+	return err
+}
+
+func (c *session) authenticate(arg string) error {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	if !c.advertised("AUTH") {
+		return c.fail("503 5.5.1 AUTH not available")
+	}
+	if c.username != "" {
+		return c.fail("503 5.5.1 already authenticated")
+	}
+	var username, password string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			var err error
+			if initial, err = c.challenge(""); err != nil {
+				return err
+			}
+		}
+		credentials, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			return c.fail("501 5.5.2 invalid base64 data")
+		}
+		// the credentials are authzid NUL authcid NUL passwd
+		fields := strings.Split(string(credentials), "\x00")
+		if len(fields) != 3 {
+			return c.fail("501 5.5.2 invalid PLAIN credentials")
+		}
+		username, password = fields[1], fields[2]
+	case "LOGIN":
+		var err error
+		if initial == "" {
+			if initial, err = c.challenge("Username:"); err != nil {
+				return err
+			}
+		}
+		user, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			return c.fail("501 5.5.2 invalid base64 data")
+		}
+		response, err := c.challenge("Password:")
+		if err != nil {
+			return err
+		}
+		pass, err := base64.StdEncoding.DecodeString(response)
+		if err != nil {
+			return c.fail("501 5.5.2 invalid base64 data")
+		}
+		username, password = string(user), string(pass)
+	default:
+		return c.fail("504 5.5.4 unrecognized authentication mechanism")
+	}
+	expected, ok := c.s.Users[username]
+	if !ok || expected != password {
+		return c.fail("535 5.7.8 authentication credentials invalid")
+	}
+	ok, err := c.write(c.s.reply("AUTH", "235 2.7.0 authentication successful"))
+	if ok {
+		c.username = username
+	}
+	return err
+}
+
+// challenge sends a 334 challenge and returns the response of the client.
+func (c *session) challenge(prompt string) (string, error) {
+	if err := c.text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+		return "", err
+	}
+	response, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if response == "*" {
+		if err := c.fail("501 5.0.0 authentication canceled"); err != nil {
+			return "", err
+		}
+		return "", errCanceled
+	}
+	return response, nil
+}
+
+func (c *session) mail(arg string) error {
+	switch {
+	case c.helo == "":
+		return c.fail("503 5.5.1 send HELO or EHLO first")
+	case c.msg != nil:
+		return c.fail("503 5.5.1 nested MAIL command")
+	case len(c.s.Users) > 0 && c.username == "":
+		return c.fail("530 5.7.0 authentication required")
+	}
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		return c.fail("501 5.5.4 syntax: MAIL FROM:<address>")
+	}
+	for _, param := range params {
+		keyword, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(keyword, "SIZE") && c.s.MaxSize > 0 {
+			if size, _ := strconv.ParseInt(value, 10, 64); size > c.s.MaxSize {
+				return c.fail("552 5.3.4 message size exceeds fixed limit")
+			}
+		}
+	}
+	ok, err := c.write(c.s.reply("MAIL", "250 2.1.0 ok"))
+	if ok {
+		c.msg = &Message{Helo: c.helo, TLS: c.tls, Username: c.username, From: from, FromParams: params}
+		c.data.Reset()
+	}
+	return err
+}
+
+func (c *session) rcpt(arg string) error {
+	if c.msg == nil {
+		return c.fail("503 5.5.1 need MAIL before RCPT")
+	}
+	to, params, ok := parsePath(arg, "TO:")
+	if !ok || to == "" {
+		return c.fail("501 5.5.4 syntax: RCPT TO:<address>")
+	}
+	ok, err := c.write(c.s.reply("RCPT", "250 2.1.5 ok"))
+	if ok {
+		c.msg.To = append(c.msg.To, Recipient{Address: to, Params: params})
+	}
+	return err
+}
+
+func (c *session) dataCmd() error {
+	if c.msg == nil || len(c.msg.To) == 0 {
+		return c.fail("503 5.5.1 need RCPT before DATA")
+	}
+	if ok, err := c.write(c.s.reply("DATA", "354 end data with <CR><LF>.<CR><LF>")); !ok || err != nil {
+		return err
+	}
+	for {
+		line, err := c.text.R.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		if string(line) == ".\r\n" || string(line) == ".\n" {
+			break
+		}
+		c.data.Write(bytes.TrimPrefix(line, []byte(".")))
+	}
+	return c.endOfData()
+}
+
+func (c *session) bdat(arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		return c.fail("501 5.5.4 syntax: BDAT size [LAST]")
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	last := len(fields) == 2 && strings.EqualFold(fields[1], "LAST")
+	if err != nil || size < 0 || len(fields) == 2 && !last {
+		return c.fail("501 5.5.4 syntax: BDAT size [LAST]")
+	}
+	// the chunk is read before replying, also when the command is rejected
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(c.text.R, chunk); err != nil {
+		return err
+	}
+	switch {
+	case !c.advertised("CHUNKING"):
+		return c.fail("502 5.5.1 BDAT not available")
+	case c.msg == nil || len(c.msg.To) == 0:
+		return c.fail("503 5.5.1 need RCPT before BDAT")
+	}
+	c.data.Write(chunk)
+	if last {
+		return c.endOfData()
+	}
+	return c.reply("BDAT", fmt.Sprintf("250 2.0.0 %d octets received", size))
+}
+
+// endOfData ends the transaction and records the message if it is accepted.
+func (c *session) endOfData() error {
+	msg := *c.msg
+	c.msg = nil
+	if c.s.MaxSize > 0 && int64(c.data.Len()) > c.s.MaxSize {
+		return c.fail("552 5.3.4 message size exceeds fixed limit")
+	}
+	// the message is recorded before the reply is sent
+	reply := c.s.reply("END-OF-DATA", "250 2.0.0 ok: queued")
+	if strings.HasPrefix(reply, "2") {
+		msg.Data = bytes.Clone(c.data.Bytes())
+		c.s.accept(msg)
+	}
+	_, err := c.write(reply)
+	return err
+}
+
+// parsePath parses the path and the parameters of MAIL FROM or RCPT TO.
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimLeft(arg[len(prefix):], " ")
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	params := strings.Fields(arg[end+1:])
+	if len(params) == 0 {
+		params = nil
+	}
+	return arg[1:end], params, true
+}
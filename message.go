@@ -33,11 +33,15 @@ type Email struct {
 	MessageID   string         `json:"message_id"`
 	ReplyTo     EmailAddress   `json:"reply_to"`
 	Recipient   string         `json:"recipient"`
+	Recipients  []string       `json:"recipients"` // envelope recipients, in place of Recipient and the header addresses
 	ReturnPath  string         `json:"returnpath"`
 	Sender      string         `json:"sender"`
 	Attachments []*Part        `json:"attachments"`
 	Images      []*Part        `json:"images"`
 	Sanitize    bool           `json:"sanitize"`
+	DSN         *DSN           `json:"dsn"`         // Delivery Status Notification parameters
+	RequireTLS  RequireTLS     `json:"require_tls"` // TLS requirement (RFC 8689)
+	MailParams  *MailParams    `json:"mail_params"` // extra MAIL FROM parameters
 }
 
 // NewEmail creates a new email message using default settings.
@@ -55,13 +59,17 @@ func NewEmail(from EmailAddress, to []EmailAddress, subject, html, text string)
 	return e
 }
 
-// Write the headers for the email to the specified writer.
-func (e *Email) writeHeaders(w io.Writer, boundary string) error {
-	// check MEssage-Id
+// setMessageID generates the Message-Id if it is empty.
+func (e *Email) setMessageID() {
 	if e.MessageID == "" {
 		_, domain := Split(e.From.Address)
 		e.MessageID = fmt.Sprintf("%s@%s", nuid.Next(), domain)
 	}
+}
+
+// Write the headers for the email to the specified writer.
+func (e *Email) writeHeaders(w io.Writer, boundary string) error {
+	e.setMessageID()
 	headers := Headers{}
 	headers = headers.Add("Message-Id", fmt.Sprintf("<%s>", e.MessageID), false)
 	headers = headers.Add("From", e.From.FormatAddress(e.CharSet), false)
@@ -86,6 +94,9 @@ func (e *Email) writeHeaders(w io.Writer, boundary string) error {
 		headers = headers.Add("Content-Type", fmt.Sprintf("%s; charset=\"%s\"", e.ContentType(), e.CharSet), false)
 		headers = headers.Add("Content-Transfer-Encoding", e.Encoding, false)
 	}
+	if e.RequireTLS == RequireTLSNo {
+		headers = headers.Add("TLS-Required", "No", false)
+	}
 	// add extended headers
 	headers = headers.AddHeaders(e.Headers)
 	err := headers.Write(w, e.CharSet)
@@ -287,6 +298,65 @@ func (e *Email) AddEmbeddedImage(filename, contentType, contentID string, body [
 	e.Images = append(e.Images, part)
 }
 
+// recipients returns the envelope recipient addresses: the Recipients or the
+// Recipient if they are setted or all the To, Cc and Bcc addresses.
+func (e *Email) recipients() []string {
+	if len(e.Recipients) > 0 {
+		return append([]string{}, e.Recipients...)
+	}
+	if e.Recipient != "" {
+		return []string{e.Recipient}
+	}
+	addrs := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
+	for _, list := range [][]EmailAddress{e.To, e.Cc, e.Bcc} {
+		for _, rec := range list {
+			addrs = append(addrs, rec.Address)
+		}
+	}
+	return addrs
+}
+
+// withRecipients returns a copy of the message sent only to the envelope recipients addrs.
+func (e *Email) withRecipients(addrs []string) *Email {
+	msg := *e
+	msg.Recipients = addrs
+	return &msg
+}
+
+// hasBinaryParts detects if the message contains parts with binary encoding.
+// These parts can be sent only to servers that support BINARYMIME.
+func (e *Email) hasBinaryParts() bool {
+	for _, list := range [][]*Part{e.Attachments, e.Images} {
+		for _, part := range list {
+			if strings.ToLower(part.Encoding) == "binary" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// downgradeBinaryParts returns a copy of the message where the encoding of
+// the binary parts is base64. The message is not modified.
+func (e *Email) downgradeBinaryParts() *Email {
+	downgrade := func(list []*Part) []*Part {
+		parts := make([]*Part, len(list))
+		for i, part := range list {
+			parts[i] = part
+			if strings.ToLower(part.Encoding) == "binary" {
+				p := *part
+				p.Encoding = "base64"
+				parts[i] = &p
+			}
+		}
+		return parts
+	}
+	msg := *e
+	msg.Attachments = downgrade(e.Attachments)
+	msg.Images = downgrade(e.Images)
+	return &msg
+}
+
 // LoadAttachment attachs a file to the message.
 func (e *Email) LoadAttachment(path string) error {
 	//os.op
@@ -0,0 +1,225 @@
+package mandala
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Resolver looks up the DNS records used by the direct delivery.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DomainResult is the outcome of the delivery to the recipients of a domain.
+type DomainResult struct {
+	Domain     string
+	Host       string       // mail exchanger used for the last attempt
+	Recipients []RcptResult // outcome of every RCPT TO command
+	Err        error
+}
+
+// MXDeliverer delivers messages directly to the mail exchangers of the
+// recipient domains, without a smarthost.
+type MXDeliverer struct {
+	// Resolver is used to look up the mail exchangers, if nil net.DefaultResolver is used.
+	Resolver Resolver
+	// Port is the SMTP port of the mail exchangers, the default is "25".
+	Port string
+	// LocalName is the name used in HELO/EHLO, the default is "localhost".
+	LocalName string
+	// TLSPolicy and TLSConfig are applied to the sessions.
+	TLSPolicy TLSPolicy
+	TLSConfig *tls.Config
+	// Dialer opens the connections to the mail exchangers, as in a *net.Dialer
+	// bound to a local source IP. If nil a net.Dialer is used.
+	Dialer Dialer
+	// Dial opens a session to the mail exchanger at addr ("host:port"). If nil
+	// the deliverer uses a SessionDialer with Dialer and DefaultTimeouts.
+	Dial func(ctx context.Context, addr string) (*Session, error)
+	// Limiter throttles the deliveries per recipient domain, if nil they are not throttled.
+	Limiter *RateLimiter
+}
+
+// NewMXDeliverer returns a new MXDeliverer using the system resolver.
+func NewMXDeliverer(localName string) *MXDeliverer {
+	return &MXDeliverer{LocalName: localName}
+}
+
+// Send delivers the message to the mail exchangers of all the recipient domains.
+func (d *MXDeliverer) Send(msg *Email) error {
+	_, err := d.Deliver(context.Background(), msg)
+	return err
+}
+
+// Deliver groups the recipients of the message by domain and delivers every
+// group over its own session, trying the mail exchangers in preference order.
+// It returns the outcome of every domain and the first failure.
+func (d *MXDeliverer) Deliver(ctx context.Context, msg *Email) ([]DomainResult, error) {
+	domains, groups := groupByDomain(msg.recipients())
+	results := make([]DomainResult, 0, len(domains))
+	var first error
+	for _, domain := range domains {
+		res := d.deliverDomain(ctx, msg, domain, groups[domain])
+		if res.Err != nil && first == nil {
+			first = res.Err
+		}
+		results = append(results, res)
+	}
+	return results, first
+}
+
+// deliverDomain delivers the message to the recipients of a domain, falling
+// back to the next mail exchanger on connection errors and transient failures.
+func (d *MXDeliverer) deliverDomain(ctx context.Context, msg *Email, domain string, addrs []string) DomainResult {
+	res := DomainResult{Domain: domain}
+	if d.Limiter != nil {
+		done, err := d.Limiter.Wait(ctx, domain)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		defer func() { done(res.Err) }()
+	}
+	hosts, err := d.lookup(ctx, domain)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	var partial *PartialDeliveryError // outcome of the previous mail exchangers, if partial
+	for _, host := range hosts {
+		res.Host = host
+		rcpts, uncertain, err := d.deliverHost(ctx, msg, host, addrs)
+		if partial != nil {
+			res.Recipients = mergeResults(res.Recipients, rcpts)
+			err = partial.retried(err)
+		} else {
+			res.Recipients = rcpts
+		}
+		res.Err = err
+		if errors.As(err, &partial) {
+			// the next mail exchanger is tried only for the recipients that can be retried
+			addrs = partial.Retry()
+		}
+		// falling back to the next mail exchanger when the server may have
+		// accepted the message could deliver it twice
+		if res.Err == nil || !IsTransient(res.Err) || uncertain || ctx.Err() != nil {
+			break
+		}
+	}
+	return res
+}
+
+// deliverHost sends the message to the recipients using the mail exchanger host.
+// The failures after the server accepted the message are ignored. On failure
+// it reports whether the server may have accepted the message anyway: the
+// connection failed after the end of the message was sent, without a reply
+// to it.
+func (d *MXDeliverer) deliverHost(ctx context.Context, msg *Email, host string, addrs []string) ([]RcptResult, bool, error) {
+	port := d.Port
+	if port == "" {
+		port = "25"
+	}
+	addr := net.JoinHostPort(host, port)
+	var c *Session
+	var err error
+	if d.Dial != nil {
+		c, err = d.Dial(ctx, addr)
+	} else {
+		sd := &SessionDialer{Address: addr, Dialer: d.Dialer, Timeouts: DefaultTimeouts}
+		c, err = sd.DialContext(ctx)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.Close()
+	c.TLSPolicy = d.TLSPolicy
+	if msg.RequireTLS == RequireTLSNo && c.TLSPolicy == TLSMandatory {
+		c.TLSPolicy = TLSOpportunistic
+	}
+	c.TLSConfig = d.TLSConfig
+	var results []RcptResult
+	var sent bool
+	err = c.runContext(ctx, func() error {
+		if d.LocalName != "" {
+			if err := c.Hello(d.LocalName); err != nil {
+				return err
+			}
+		}
+		if err := c.StartSession(); err != nil {
+			return err
+		}
+		var err error
+		results, err = c.sendTo(msg, addrs)
+		if err != nil {
+			return err
+		}
+		sent = true
+		return c.Quit()
+	})
+	if sent {
+		return results, true, nil
+	}
+	return results, c.uncertain(err), err
+}
+
+// lookup returns the mail exchangers of the domain in preference order.
+// If the domain has no MX records the domain itself is used (RFC 5321 section 5.1).
+func (d *MXDeliverer) lookup(ctx context.Context, domain string) ([]string, error) {
+	var r Resolver = net.DefaultResolver
+	if d.Resolver != nil {
+		r = d.Resolver
+	}
+	mxs, err := r.LookupMX(ctx, domain)
+	var derr *net.DNSError
+	if err != nil && !(errors.As(err, &derr) && derr.IsNotFound) {
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		// implicit MX: the domain must have an address record
+		if _, err := r.LookupHost(ctx, domain); err != nil {
+			return nil, err
+		}
+		return []string{domain}, nil
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// null MX (RFC 7505): the domain does not accept mail
+			return nil, &textproto.Error{Code: 556, Msg: fmt.Sprintf("5.1.10 domain %s does not accept mail", domain)}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// groupByDomain groups the addresses by domain, converting the domains to
+// lowercase ASCII (IDNA). It returns the domains in order of appearance.
+func groupByDomain(addrs []string) ([]string, map[string][]string) {
+	domains := make([]string, 0)
+	groups := make(map[string][]string)
+	for _, addr := range addrs {
+		_, domain := Split(addr)
+		domain = strings.ToLower(domain)
+		// the same domain may be written in Unicode and in ASCII
+		if ascii, err := idna.ToASCII(domain); err == nil {
+			domain = ascii
+		}
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], addr)
+	}
+	return domains, groups
+}
@@ -0,0 +1,138 @@
+package mandala
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver resolves the MX records from a map.
+type fakeResolver map[string][]*net.MX
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if host == "nowhere.test" {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []string{"192.0.2.1"}, nil
+}
+
+// failWriter records the commands until a write containing fail, that fails
+// as a broken connection.
+type failWriter struct {
+	io.Writer
+	fail string
+}
+
+func (w failWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), w.fail) {
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")}
+	}
+	return w.Writer.Write(p)
+}
+
+func TestMXDeliverer_Deliver(t *testing.T) {
+	resolver := fakeResolver{
+		"a.test":    {{Host: "mx2.a.test.", Pref: 20}, {Host: "mx1.a.test.", Pref: 10}},
+		"null.test": {{Host: ".", Pref: 0}},
+		"c.test":    {{Host: "mx1.c.test.", Pref: 10}, {Host: "mx2.c.test.", Pref: 20}},
+		"d.test":    {{Host: "mx1.d.test.", Pref: 10}, {Host: "mx2.d.test.", Pref: 20}},
+		"e.test":    {{Host: "mx1.e.test.", Pref: 10}, {Host: "mx2.e.test.", Pref: 20}},
+		"f.test":    {{Host: "mx1.f.test.", Pref: 10}, {Host: "mx2.f.test.", Pref: 20}},
+	}
+	// replies of every mail exchanger to the RCPT TO commands
+	servers := map[string][]string{
+		"mx1.a.test:25": {"220 hello", "250 mx1", "250 ok", "250 ok", "250 ok", "354 go", "421 busy"},
+		"mx2.a.test:25": {"220 hello", "250 mx2", "250 ok", "250 ok", "250 ok", "354 go", "250 queued", "221 bye"},
+		"b.test:25":     {"220 hello", "250 b", "250 ok", "250 ok", "354 go", "250 queued", "221 bye"},
+		// the connection is lost after the message is accepted
+		"mx1.c.test:25": {"220 hello", "250 mx1", "250 ok", "250 ok", "354 go", "250 queued"},
+		"mx2.c.test:25": {"220 hello", "250 mx2", "250 ok", "250 ok", "354 go", "250 queued", "221 bye"},
+		// the connection is lost before the reply to the message
+		"mx1.d.test:25": {"220 hello", "250 mx1", "250 ok", "250 ok", "354 go"},
+		"mx2.d.test:25": {"220 hello", "250 mx2", "250 ok", "250 ok", "354 go", "250 queued", "221 bye"},
+		// LMTP servers delivering the message to some of the recipients
+		"mx1.e.test:25": {"220 hello", "250 mx1", "250 ok", "250 ok", "250 ok", "354 go", "250 ok", "452 mailbox full", "221 bye"},
+		"mx2.e.test:25": {"220 hello", "250 mx2", "250 ok", "250 ok", "354 go", "250 ok", "221 bye"},
+		// the connection is lost while the message is sent
+		"mx1.f.test:25": {"220 hello", "250 mx1", "250 ok", "250 ok", "354 go"},
+		"mx2.f.test:25": {"220 hello", "250 mx2", "250 ok", "250 ok", "354 go", "250 queued", "221 bye"},
+	}
+	tests := []struct {
+		name     string
+		to       []string
+		wantHost map[string]string
+		wantErr  map[string]bool
+	}{
+		{name: "MX fallback and implicit MX", to: []string{"x@a.test", "y@b.test", "z@A.test"},
+			wantHost: map[string]string{"a.test": "mx2.a.test", "b.test": "b.test"}},
+		{name: "connection lost after the message", to: []string{"x@c.test"}, wantHost: map[string]string{"c.test": "mx1.c.test"}},
+		{name: "connection lost before the reply", to: []string{"x@d.test"}, wantErr: map[string]bool{"d.test": true}},
+		{name: "connection lost during the message", to: []string{"x@f.test"}, wantHost: map[string]string{"f.test": "mx2.f.test"}},
+		{name: "partial delivery", to: []string{"x@e.test", "y@e.test"}, wantHost: map[string]string{"e.test": "mx2.e.test"}},
+		{name: "null MX", to: []string{"x@null.test"}, wantErr: map[string]bool{"null.test": true}},
+		{name: "no address", to: []string{"x@nowhere.test"}, wantErr: map[string]bool{"nowhere.test": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds := make(map[string]*bytes.Buffer)
+			d := NewMXDeliverer("client.test")
+			d.Resolver = resolver
+			d.Dial = func(ctx context.Context, addr string) (*Session, error) {
+				c, buf := newFakeSession(t, servers[addr]...)
+				if addr == "mx1.f.test:25" {
+					conn := faker{Reader: strings.NewReader(strings.Join(servers[addr], "\r\n") + "\r\n"), Writer: failWriter{buf, "Hello world!"}}
+					c, _ = NewSessionUsingConnection(conn, "fake.host", nil)
+				}
+				c.LMTP = strings.HasSuffix(addr, ".e.test:25")
+				cmds[addr] = buf
+				return c, nil
+			}
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, nil, "Hello", "", "Hello world!")
+			for _, to := range tt.to {
+				msg.To = append(msg.To, EmailAddress{Address: to})
+			}
+			results, _ := d.Deliver(context.Background(), msg)
+			for _, res := range results {
+				if (res.Err != nil) != tt.wantErr[res.Domain] {
+					t.Errorf("MXDeliverer.Deliver() %s error = %v", res.Domain, res.Err)
+				}
+				if want, ok := tt.wantHost[res.Domain]; ok && res.Host != want {
+					t.Errorf("MXDeliverer.Deliver() %s host = %v, want %v", res.Domain, res.Host, want)
+				}
+			}
+			if len(results) != len(tt.wantHost)+len(tt.wantErr) {
+				t.Errorf("MXDeliverer.Deliver() results = %v", results)
+			}
+			for addr := range cmds {
+				if strings.HasPrefix(addr, "mx2.c.test") || strings.HasPrefix(addr, "mx2.d.test") {
+					t.Errorf("MXDeliverer.Deliver() fell back to %s after the message was sent", addr)
+				}
+			}
+			if buf, ok := cmds["b.test:25"]; ok {
+				FindSnippets(t, buf.String(), []string{"EHLO client.test\r\n", "RCPT TO:<y@b.test>\r\nDATA"})
+			}
+			if buf, ok := cmds["mx2.e.test:25"]; ok && strings.Contains(buf.String(), "RCPT TO:<x@e.test>") {
+				t.Errorf("MXDeliverer.Deliver() sent again to the delivered recipient: %q", buf.String())
+			}
+		})
+	}
+}
+
+func TestGroupByDomain(t *testing.T) {
+	domains, groups := groupByDomain([]string{"a@x.test", "b@y.test", "c@X.test", "d@BÜCHER.test", "e@xn--bcher-kva.test"})
+	if strings.Join(domains, ",") != "x.test,y.test,xn--bcher-kva.test" || len(groups["x.test"]) != 2 || len(groups["xn--bcher-kva.test"]) != 2 {
+		t.Errorf("groupByDomain() = %v, %v", domains, groups)
+	}
+}
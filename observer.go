@@ -0,0 +1,106 @@
+package mandala
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Phase is a phase of the SMTP dialog reported to an Observer.
+type Phase string
+
+// Phases reported to an Observer.
+const (
+	PhaseConnect Phase = "connect" // connection and greeting
+	PhaseTLS     Phase = "tls"     // STARTTLS and TLS handshake
+	PhaseHello   Phase = "hello"   // EHLO or HELO
+	PhaseAuth    Phase = "auth"    // whole AUTH exchange
+	PhaseMail    Phase = "mail"    // MAIL FROM
+	PhaseRcpt    Phase = "rcpt"    // every RCPT TO
+	PhaseData    Phase = "data"    // upload of the message up to the final reply
+	PhaseMessage Phase = "message" // whole sending of a message
+)
+
+// PhaseEvent describes a completed phase of a session.
+type PhaseEvent struct {
+	Phase     Phase
+	Server    string // server name of the session
+	Duration  time.Duration
+	Code      int    // reply code, 0 if no reply has been received
+	Recipient string // recipient of PhaseRcpt
+	Bytes     int64  // bytes of the message sent in PhaseData and PhaseMessage
+	Err       error
+}
+
+// Class returns the class of the reply code ("2xx", "3xx", "4xx" or "5xx"),
+// or an empty string if no reply has been received.
+func (e PhaseEvent) Class() string {
+	if e.Code < 200 || e.Code > 599 {
+		return ""
+	}
+	return string(rune('0'+e.Code/100)) + "xx"
+}
+
+// Observer receives the events of the sessions to collect latency and outcome
+// metrics. Observe is called synchronously, so it should return quickly, and an
+// Observer shared by many sessions must be safe for concurrent use.
+type Observer interface {
+	Observe(e PhaseEvent)
+}
+
+// ObserverFunc is an adapter to use an ordinary function as an Observer.
+type ObserverFunc func(e PhaseEvent)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e PhaseEvent) {
+	f(e)
+}
+
+// NopObserver is an Observer that discards the events. A session with a nil
+// Observer behaves as if it had a NopObserver.
+type NopObserver struct{}
+
+// Observe does nothing.
+func (NopObserver) Observe(e PhaseEvent) {}
+
+// observe passes the event of a phase started at start to the Observer.
+// The connection event, recorded before the Observer could be set, is passed first.
+func (c *Session) observe(e PhaseEvent, start time.Time) {
+	o := c.Observer
+	if o == nil {
+		return
+	}
+	if c.connect != nil {
+		connect := *c.connect
+		c.connect = nil
+		o.Observe(connect)
+	}
+	e.Server = c.serverName
+	e.Duration = time.Since(start)
+	o.Observe(e)
+}
+
+// replyCode returns the reply code of the outcome of a command: ok if err
+// is nil, the code of the error reply or 0 if no reply has been received.
+func replyCode(err error, ok int) int {
+	if err == nil {
+		return ok
+	}
+	var serr *SMTPError
+	if errors.As(err, &serr) {
+		return serr.Code
+	}
+	return 0
+}
+
+// countWriter counts the bytes written.
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
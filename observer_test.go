@@ -0,0 +1,80 @@
+package mandala
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSession_Observer(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}, EmailAddress{Address: "to2@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name       string
+		server     []string
+		wantErr    bool
+		wantPhases []Phase
+		wantCodes  []int
+	}{
+		{name: "sent", server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "251 forwarded", "354 go", "250 queued"},
+			wantPhases: []Phase{PhaseConnect, PhaseHello, PhaseMail, PhaseRcpt, PhaseRcpt, PhaseData, PhaseMessage},
+			wantCodes:  []int{220, 250, 250, 250, 251, 250, 250}},
+		{name: "pipelined", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "250 ok", "250 ok", "354 go", "250 queued"},
+			wantPhases: []Phase{PhaseConnect, PhaseHello, PhaseMail, PhaseRcpt, PhaseRcpt, PhaseData, PhaseMessage},
+			wantCodes:  []int{220, 250, 250, 250, 250, 250, 250}},
+		{name: "bdat", server: []string{"220 hello", "250-fake.host", "250 CHUNKING", "250 ok", "250 ok", "250 ok", "250 queued"},
+			wantPhases: []Phase{PhaseConnect, PhaseHello, PhaseMail, PhaseRcpt, PhaseRcpt, PhaseData, PhaseMessage},
+			wantCodes:  []int{220, 250, 250, 250, 250, 250, 250}},
+		{name: "rejected", server: []string{"220 hello", "250 fake.host", "250 ok", "550 no such user", "250 reset"}, wantErr: true,
+			wantPhases: []Phase{PhaseConnect, PhaseHello, PhaseMail, PhaseRcpt, PhaseMessage},
+			wantCodes:  []int{220, 250, 250, 550, 550}},
+		{name: "data rejected", server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "250 ok", "354 go", "554 spam"}, wantErr: true,
+			wantPhases: []Phase{PhaseConnect, PhaseHello, PhaseMail, PhaseRcpt, PhaseRcpt, PhaseData, PhaseMessage},
+			wantCodes:  []int{220, 250, 250, 250, 250, 554, 554}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeSession(t, tt.server...)
+			var events []PhaseEvent
+			c.Observer = ObserverFunc(func(e PhaseEvent) { events = append(events, e) })
+			err := c.SendSingleMessage(msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Session.SendSingleMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			phases := make([]Phase, 0, len(events))
+			codes := make([]int, 0, len(events))
+			for _, e := range events {
+				phases = append(phases, e.Phase)
+				codes = append(codes, e.Code)
+				if e.Server != "fake.host" {
+					t.Errorf("PhaseEvent.Server = %q, want fake.host", e.Server)
+				}
+				if e.Phase == PhaseData && e.Err == nil && e.Bytes == 0 {
+					t.Errorf("PhaseEvent.Bytes = 0 for %v", e.Phase)
+				}
+			}
+			if !reflect.DeepEqual(phases, tt.wantPhases) || !reflect.DeepEqual(codes, tt.wantCodes) {
+				t.Errorf("phases = %v %v, want %v %v", phases, codes, tt.wantPhases, tt.wantCodes)
+			}
+			if rcpt := events[3]; rcpt.Recipient != "to1@test.com" {
+				t.Errorf("PhaseEvent.Recipient = %q, want to1@test.com", rcpt.Recipient)
+			}
+		})
+	}
+}
+
+func TestPhaseEvent_Class(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{code: 250, want: "2xx"},
+		{code: 354, want: "3xx"},
+		{code: 421, want: "4xx"},
+		{code: 550, want: "5xx"},
+		{code: 0, want: ""},
+	}
+	for _, tt := range tests {
+		if got := (PhaseEvent{Code: tt.code}).Class(); got != tt.want {
+			t.Errorf("PhaseEvent.Class() = %q, want %q", got, tt.want)
+		}
+	}
+}
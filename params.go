@@ -0,0 +1,165 @@
+package mandala
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrParamNotSupported is returned when a MAIL FROM parameter requires an extension the server does not support.
+var ErrParamNotSupported = errors.New("smtp: server does not support the MAIL FROM parameter")
+
+// MailParams contains the extra parameters of the MAIL FROM command of a message.
+// Every parameter is checked against the extensions advertised by the server.
+type MailParams struct {
+	// Priority is the MT-PRIORITY of the message, from -9 to 9 (RFC 6710).
+	// The default 0 is not sent and the priority is dropped if the server
+	// does not support MT-PRIORITY.
+	Priority int `json:"priority"`
+	// HoldFor and HoldUntil ask the server to hold the message before the
+	// delivery with FUTURERELEASE (RFC 4865), only one of them can be set.
+	HoldFor   time.Duration `json:"hold_for"`
+	HoldUntil time.Time     `json:"hold_until"`
+	// DeliverBy is the time allowed for the delivery with DELIVERBY (RFC 2852).
+	DeliverBy      time.Duration `json:"deliver_by"`
+	DeliverByMode  string        `json:"deliver_by_mode"`  // "R" to return the message when expired (the default), "N" to notify
+	DeliverByTrace bool          `json:"deliver_by_trace"` // ask for delay notifications along the route
+	// Extra are vendor parameters.
+	Extra []MailParam `json:"extra"`
+}
+
+// MailParam is a vendor parameter of the MAIL FROM command.
+type MailParam struct {
+	Keyword   string `json:"keyword"`
+	Value     string `json:"value"`     // sent xtext encoded, if empty only the keyword is sent
+	Extension string `json:"extension"` // extension the server must advertise, if empty the parameter is always sent
+	Optional  bool   `json:"optional"`  // drop the parameter if the server does not advertise the extension
+}
+
+// mailParams returns the extra parameters of MAIL FROM for the message.
+func (c *Session) mailParams(msg *Email) (string, error) {
+	p := msg.MailParams
+	if p == nil {
+		return "", nil
+	}
+	var params string
+	if p.Priority != 0 {
+		if p.Priority < -9 || p.Priority > 9 {
+			return "", fmt.Errorf("smtp: invalid MT-PRIORITY value %d", p.Priority)
+		}
+		if ok, _ := c.Extension("MT-PRIORITY"); ok {
+			params += fmt.Sprintf(" MT-PRIORITY=%d", p.Priority)
+		}
+	}
+	release, err := c.futureRelease(p)
+	if err != nil {
+		return "", err
+	}
+	params += release
+	by, err := c.deliverBy(p)
+	if err != nil {
+		return "", err
+	}
+	params += by
+	for _, e := range p.Extra {
+		if !validKeyword(e.Keyword) {
+			return "", fmt.Errorf("smtp: invalid MAIL FROM parameter %q", e.Keyword)
+		}
+		if e.Extension != "" {
+			if ok, _ := c.Extension(e.Extension); !ok {
+				if e.Optional {
+					continue
+				}
+				return "", fmt.Errorf("%w %s", ErrParamNotSupported, e.Keyword)
+			}
+		}
+		params += " " + strings.ToUpper(e.Keyword)
+		if e.Value != "" {
+			params += "=" + xtext(e.Value)
+		}
+	}
+	return params, nil
+}
+
+// futureRelease returns the HOLDFOR or HOLDUNTIL parameter, checking the
+// maximum interval and date-time advertised by the server.
+func (c *Session) futureRelease(p *MailParams) (string, error) {
+	if p.HoldFor == 0 && p.HoldUntil.IsZero() {
+		return "", nil
+	}
+	if p.HoldFor != 0 && !p.HoldUntil.IsZero() {
+		return "", errors.New("smtp: FUTURERELEASE HOLDFOR and HOLDUNTIL can not be combined")
+	}
+	ok, limits := c.Extension("FUTURERELEASE")
+	if !ok {
+		return "", fmt.Errorf("%w FUTURERELEASE", ErrParamNotSupported)
+	}
+	// the server advertises the maximum interval in seconds and the maximum date-time
+	var maxInterval int64
+	var maxDate time.Time
+	if fields := strings.Fields(limits); len(fields) == 2 {
+		maxInterval, _ = strconv.ParseInt(fields[0], 10, 64)
+		maxDate, _ = time.Parse(time.RFC3339, fields[1])
+	}
+	if p.HoldFor != 0 {
+		seconds := int64(p.HoldFor / time.Second)
+		if seconds <= 0 {
+			return "", fmt.Errorf("smtp: invalid FUTURERELEASE HOLDFOR value %v", p.HoldFor)
+		}
+		if maxInterval > 0 && seconds > maxInterval {
+			return "", fmt.Errorf("smtp: FUTURERELEASE HOLDFOR %v exceeds the server limit of %d seconds", p.HoldFor, maxInterval)
+		}
+		return fmt.Sprintf(" HOLDFOR=%d", seconds), nil
+	}
+	if !maxDate.IsZero() && p.HoldUntil.After(maxDate) {
+		return "", fmt.Errorf("smtp: FUTURERELEASE HOLDUNTIL %v exceeds the server limit of %v", p.HoldUntil, maxDate)
+	}
+	return " HOLDUNTIL=" + p.HoldUntil.UTC().Format(time.RFC3339), nil
+}
+
+// deliverBy returns the BY parameter, checking the minimum time advertised by the server.
+func (c *Session) deliverBy(p *MailParams) (string, error) {
+	if p.DeliverBy == 0 {
+		return "", nil
+	}
+	ok, limit := c.Extension("DELIVERBY")
+	if !ok {
+		return "", fmt.Errorf("%w DELIVERBY", ErrParamNotSupported)
+	}
+	mode := strings.ToUpper(p.DeliverByMode)
+	switch mode {
+	case "":
+		mode = "R"
+	case "R", "N":
+	default:
+		return "", fmt.Errorf("smtp: invalid DELIVERBY mode %q", p.DeliverByMode)
+	}
+	seconds := int64(p.DeliverBy / time.Second)
+	if mode == "R" {
+		// in return mode the time must be positive and not less than the server minimum
+		minTime, _ := strconv.ParseInt(limit, 10, 64)
+		if seconds <= 0 || seconds < minTime {
+			return "", fmt.Errorf("smtp: DELIVERBY time %v is less than the server minimum of %d seconds", p.DeliverBy, max(minTime, 1))
+		}
+	}
+	if p.DeliverByTrace {
+		mode += "T"
+	}
+	return fmt.Sprintf(" BY=%d;%s", seconds, mode), nil
+}
+
+// validKeyword reports whether s is a valid esmtp-keyword (RFC 5321 section 4.1.2).
+func validKeyword(s string) bool {
+	if s == "" || s[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
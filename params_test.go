@@ -0,0 +1,77 @@
+package mandala
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSession_MailAndRcpt_MailParams(t *testing.T) {
+	until := time.Date(2026, 10, 20, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		params   *MailParams
+		ehlo     string
+		wantErr  error
+		snippets []string
+	}{
+		{name: "priority", params: &MailParams{Priority: -3}, ehlo: "250 MT-PRIORITY MIXER",
+			snippets: []string{"MAIL FROM:<from@test.com> MT-PRIORITY=-3\r\n"}},
+		{name: "priority not supported", params: &MailParams{Priority: 5}, ehlo: "250 DSN",
+			snippets: []string{"MAIL FROM:<from@test.com>\r\n"}},
+		{name: "hold for", params: &MailParams{HoldFor: 2 * time.Hour}, ehlo: "250 FUTURERELEASE 604800 2026-10-24T00:00:00Z",
+			snippets: []string{"MAIL FROM:<from@test.com> HOLDFOR=7200\r\n"}},
+		{name: "hold until", params: &MailParams{HoldUntil: until}, ehlo: "250 FUTURERELEASE 604800 2026-10-24T00:00:00Z",
+			snippets: []string{"MAIL FROM:<from@test.com> HOLDUNTIL=2026-10-20T10:00:00Z\r\n"}},
+		{name: "hold not supported", params: &MailParams{HoldFor: time.Hour}, ehlo: "250 DSN", wantErr: ErrParamNotSupported},
+		{name: "deliver by", params: &MailParams{DeliverBy: 10 * time.Minute, DeliverByTrace: true}, ehlo: "250 DELIVERBY 120",
+			snippets: []string{"MAIL FROM:<from@test.com> BY=600;RT\r\n"}},
+		{name: "deliver by notify", params: &MailParams{DeliverBy: -time.Minute, DeliverByMode: "n"}, ehlo: "250 DELIVERBY",
+			snippets: []string{"MAIL FROM:<from@test.com> BY=-60;N\r\n"}},
+		{name: "deliver by not supported", params: &MailParams{DeliverBy: time.Hour}, ehlo: "250 DSN", wantErr: ErrParamNotSupported},
+		{name: "vendor", params: &MailParams{Extra: []MailParam{{Keyword: "x-tag", Value: "a b=c"}, {Keyword: "XFLAG"}}}, ehlo: "250 DSN",
+			snippets: []string{"MAIL FROM:<from@test.com> X-TAG=a+20b+3Dc XFLAG\r\n"}},
+		{name: "vendor extension", params: &MailParams{Extra: []MailParam{{Keyword: "XVERP", Extension: "XVERP"}}}, ehlo: "250 XVERP",
+			snippets: []string{"MAIL FROM:<from@test.com> XVERP\r\n"}},
+		{name: "vendor optional", params: &MailParams{Extra: []MailParam{{Keyword: "XVERP", Extension: "XVERP", Optional: true}}}, ehlo: "250 DSN",
+			snippets: []string{"MAIL FROM:<from@test.com>\r\n"}},
+		{name: "vendor not supported", params: &MailParams{Extra: []MailParam{{Keyword: "XVERP", Extension: "XVERP"}}}, ehlo: "250 DSN",
+			wantErr: ErrParamNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+			msg.MailParams = tt.params
+			c, cmds := newFakeSession(t, "220 hello", "250-fake.host", tt.ehlo, "250 ok", "250 ok")
+			if err := c.MailAndRcpt(msg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Session.MailAndRcpt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			FindSnippets(t, cmds.String(), tt.snippets)
+		})
+	}
+}
+
+func TestSession_MailParams_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		params *MailParams
+	}{
+		{name: "priority out of range", params: &MailParams{Priority: 10}},
+		{name: "hold for and until", params: &MailParams{HoldFor: time.Hour, HoldUntil: time.Now().Add(time.Hour)}},
+		{name: "hold for over the limit", params: &MailParams{HoldFor: 8 * 24 * time.Hour}},
+		{name: "hold until over the limit", params: &MailParams{HoldUntil: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)}},
+		{name: "deliver by under the minimum", params: &MailParams{DeliverBy: time.Minute}},
+		{name: "deliver by mode", params: &MailParams{DeliverBy: time.Hour, DeliverByMode: "X"}},
+		{name: "vendor keyword", params: &MailParams{Extra: []MailParam{{Keyword: "X TAG"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+			msg.MailParams = tt.params
+			c, _ := newFakeSession(t, "220 hello", "250-fake.host", "250-MT-PRIORITY", "250-FUTURERELEASE 604800 2026-10-24T00:00:00Z", "250 DELIVERBY 120")
+			if _, err := c.mailParams(msg); err == nil {
+				t.Errorf("Session.mailParams() error = nil, want an error")
+			}
+		})
+	}
+}
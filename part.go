@@ -15,7 +15,7 @@ type Part struct {
 	Filename           string `json:"filename"`
 	ContentType        string `json:"content_type"`
 	ContentDisposition string `json:"content_disposition"` // "attachment"
-	Encoding           string `json:"encoding"`            // "quoted-printable", "base64", "8bit"
+	Encoding           string `json:"encoding"`            // "quoted-printable", "base64", "8bit", "binary"
 	CharSet            string `json:"charset"`             // "utf-8", "iso-8859-1", ...
 	ContentID          string `json:"content_id"`
 	Body               []byte `json:"body"`
@@ -54,6 +54,8 @@ func (a *Part) contentType() string {
 		return "base64"
 	case "8bit":
 		return "8bit"
+	case "binary":
+		return "binary"
 	default:
 		return "quoted-printable"
 	}
@@ -68,7 +70,7 @@ func WriteEncodedBody(p io.Writer, body []byte, encoding string) (err error) {
 		if _, err := p.Write(encoded); err != nil {
 			return err
 		}
-	case "8bit":
+	case "8bit", "binary":
 		if _, err := p.Write(body); err != nil {
 			return err
 		}
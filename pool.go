@@ -0,0 +1,211 @@
+package mandala
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// ErrPoolClosed is returned by the SessionPool methods after the pool has been closed.
+var ErrPoolClosed = errors.New("mandala: session pool is closed")
+
+// SessionPool creates and reuses authenticated sessions to the same SMTP server.
+// A SessionPool is safe for concurrent use by multiple goroutines.
+type SessionPool struct {
+	// Host is the address of the SMTP server, as in "mail.example.com:smtp".
+	Host string
+	// Auth is the authentication mechanism used to open new sessions.
+	Auth smtp.Auth
+	// MaxIdle is the maximum number of idle sessions kept open.
+	MaxIdle int
+	// MaxOpen is the maximum number of open sessions, 0 means unlimited.
+	MaxOpen int
+	// MaxMessages is the maximum number of messages sent using the same session
+	// before it is closed, 0 means unlimited. The messages rejected or failed
+	// are not counted.
+	MaxMessages int
+	// HealthCheck is the command ("NOOP" or "RSET") sent to an idle session
+	// before reusing it. An empty string disables the check.
+	HealthCheck string
+	// TLSPolicy and TLSConfig are applied to the new sessions.
+	TLSPolicy TLSPolicy
+	TLSConfig *tls.Config
+	// Dial opens a new session ready to send messages. If nil the pool uses
+	// NewSession and StartSession with Host and Auth.
+	Dial func() (*Session, error)
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	idle   []*Session
+	open   int
+	closed bool
+}
+
+// NewSessionPool returns a new SessionPool for the SMTP server at host.
+func NewSessionPool(host string, a smtp.Auth, maxIdle, maxOpen int) *SessionPool {
+	return &SessionPool{Host: host, Auth: a, MaxIdle: maxIdle, MaxOpen: maxOpen, HealthCheck: "NOOP"}
+}
+
+// Get returns an open session taken from the pool or a new one if no idle
+// session is available. It blocks when MaxOpen sessions are already in use.
+// The session must be given back to the pool calling Put.
+func (p *SessionPool) Get() (*Session, error) {
+	p.mu.Lock()
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.mu)
+	}
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			c := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			if err := p.check(c); err != nil {
+				c.Close()
+				p.mu.Lock()
+				p.open--
+				continue
+			}
+			return c, nil
+		}
+		if p.MaxOpen <= 0 || p.open < p.MaxOpen {
+			p.open++
+			p.mu.Unlock()
+			c, err := p.dial()
+			if err != nil {
+				p.release()
+				return nil, err
+			}
+			return c, nil
+		}
+		p.cond.Wait()
+	}
+}
+
+// Put gives a session back to the pool. The error is the outcome of the last
+// operation done with the session: if it shows that the connection is broken,
+// the session is discarded.
+func (p *SessionPool) Put(c *Session, err error) {
+	broken := isBroken(c, err)
+	p.mu.Lock()
+	reuse := !p.closed && !broken && len(p.idle) < p.MaxIdle &&
+		(p.MaxMessages <= 0 || c.Messages() < p.MaxMessages)
+	if reuse {
+		p.idle = append(p.idle, c)
+		if p.cond != nil {
+			p.cond.Signal()
+		}
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	if !broken {
+		c.Quit()
+	}
+	c.Close()
+	p.release()
+}
+
+// Send sends the message using a session taken from the pool.
+func (p *SessionPool) Send(msg *Email) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+	err = c.SendSingleMessage(msg)
+	p.Put(c, err)
+	return err
+}
+
+// Close closes all the idle sessions. The sessions in use are closed when
+// they are given back to the pool.
+func (p *SessionPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.open -= len(idle)
+	if p.cond != nil {
+		p.cond.Broadcast()
+	}
+	p.mu.Unlock()
+	var err error
+	for _, c := range idle {
+		c.Quit()
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// release frees the slot of a closed session.
+func (p *SessionPool) release() {
+	p.mu.Lock()
+	p.open--
+	if p.cond != nil {
+		p.cond.Signal()
+	}
+	p.mu.Unlock()
+}
+
+// dial opens a new session.
+func (p *SessionPool) dial() (*Session, error) {
+	if p.Dial != nil {
+		return p.Dial()
+	}
+	c, err := NewSession(p.Host, p.Auth)
+	if err != nil {
+		return nil, err
+	}
+	c.TLSPolicy = p.TLSPolicy
+	c.TLSConfig = p.TLSConfig
+	if err := c.StartSession(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// check verifies that an idle session is still usable.
+func (p *SessionPool) check(c *Session) error {
+	switch strings.ToUpper(p.HealthCheck) {
+	case "NOOP":
+		return c.Noop()
+	case "RSET":
+		return c.Reset()
+	}
+	return nil
+}
+
+// isBroken reports whether the session can not be used anymore after the
+// operation that returned err. I/O errors, a closed connection, an interrupted
+// operation and the 421 reply break the session; the replies of the server
+// and the local errors, as a SizeError, leave it usable.
+func isBroken(c *Session, err error) bool {
+	if c.data == dataStarted {
+		// the message was interrupted: the server is still reading it
+		return true
+	}
+	if err == nil {
+		return false
+	}
+	var nerr net.Error
+	var perr textproto.ProtocolError
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, context.Canceled) || errors.As(err, &nerr) || errors.As(err, &perr) {
+		return true
+	}
+	// 421 Service not available, closing transmission channel
+	var terr *textproto.Error
+	return errors.As(err, &terr) && terr.Code == 421
+}
@@ -0,0 +1,115 @@
+package mandala
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+)
+
+func TestSessionPool_Send(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name        string
+		maxMessages int
+		sends       int
+		rejected    bool // the first message is rejected
+		wantDials   int
+	}{
+		{name: "reuse the session", maxMessages: 0, sends: 2, wantDials: 1},
+		{name: "one message per session", maxMessages: 1, sends: 2, wantDials: 2},
+		{name: "rejected message not counted", maxMessages: 1, sends: 2, rejected: true, wantDials: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewSessionPool("fake.host:25", nil, 1, 1)
+			p.MaxMessages = tt.maxMessages
+			dials := 0
+			p.Dial = func() (*Session, error) {
+				dials++
+				first := []string{"250 ok", "250 ok", "354 go", "250 queued"}
+				if tt.rejected {
+					first = []string{"250 ok", "550 no such user", "250 reset"}
+				}
+				server := append([]string{"220 hello", "250 fake.host"}, first...)
+				server = append(server, "250 noop", "250 ok", "250 ok", "354 go", "250 queued", "221 bye")
+				c, _ := newFakeSession(t, server...)
+				return c, nil
+			}
+			for i := 0; i < tt.sends; i++ {
+				if err := p.Send(msg); (err != nil) != (tt.rejected && i == 0) {
+					t.Errorf("SessionPool.Send() error = %v", err)
+				}
+			}
+			if dials != tt.wantDials {
+				t.Errorf("SessionPool.Send() dials = %v, want %v", dials, tt.wantDials)
+			}
+			p.Close()
+			if _, err := p.Get(); err != ErrPoolClosed {
+				t.Errorf("SessionPool.Get() error = %v, want %v", err, ErrPoolClosed)
+			}
+		})
+	}
+}
+
+func TestSessionPool_MaxOpen(t *testing.T) {
+	p := NewSessionPool("fake.host:25", nil, 0, 2)
+	p.HealthCheck = ""
+	p.Dial = func() (*Session, error) {
+		c, _ := newFakeSession(t, "220 hello", "250 fake.host", "221 bye")
+		return c, nil
+	}
+	c1, _ := p.Get()
+	c2, _ := p.Get()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c3, err := p.Get()
+		if err != nil {
+			t.Errorf("SessionPool.Get() error = %v", err)
+			return
+		}
+		p.Put(c3, nil)
+	}()
+	p.Put(c1, nil)
+	wg.Wait()
+	p.Put(c2, nil)
+	if p.open != 0 {
+		t.Errorf("SessionPool open = %v, want 0", p.open)
+	}
+}
+
+func TestIsBroken(t *testing.T) {
+	tests := []struct {
+		name string
+		data dataState
+		err  error
+		want bool
+	}{
+		{name: "no error", want: false},
+		{name: "size exceeded", err: &SizeError{Size: 100, Limit: 10}, want: false},
+		{name: "invalid message", err: errors.New("From address can not be empty"), want: false},
+		{name: "rejected recipient", err: &RcptError{Recipient: "to@test.com", Err: &textproto.Error{Code: 550, Msg: "no such user"}}, want: false},
+		{name: "service not available", err: &textproto.Error{Code: 421, Msg: "closing"}, want: true},
+		{name: "service not available reply", err: &SMTPError{Command: "MAIL", Code: 421, Message: "closing"}, want: true},
+		{name: "rejected", err: &SMTPError{Command: "MAIL", Code: 550, Message: "rejected"}, want: false},
+		{name: "connection lost", err: io.EOF, want: true},
+		{name: "connection closed", err: fmt.Errorf("aborted: %w", net.ErrClosed), want: true},
+		{name: "network error", err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, want: true},
+		{name: "canceled", err: context.Canceled, want: true},
+		{name: "message interrupted", data: dataStarted, err: errors.New("attachment not found"), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Session{data: tt.data}
+			if got := isBroken(c, tt.err); got != tt.want {
+				t.Errorf("isBroken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
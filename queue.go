@@ -0,0 +1,391 @@
+package mandala
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// Sender sends a message. SessionPool, MXDeliverer and LimitedSender
+// implement Sender. RetrySender does not: the Queue retries the messages
+// itself following its Policy.
+type Sender interface {
+	Send(msg *Email) error
+}
+
+// DefaultPollInterval is the interval between two scans of the spool used
+// when Queue.PollInterval is 0.
+const DefaultPollInterval = time.Minute
+
+// ErrNotQueued is returned when a message is not in the queue.
+var ErrNotQueued = errors.New("mandala: message not found in the queue")
+
+// States of a queued message.
+const (
+	QueueStateDeferred = "deferred" // waiting for the next attempt
+	QueueStateActive   = "active"   // being sent
+	QueueStateFailed   = "failed"   // failed permanently or expired
+)
+
+// spool subdirectories
+const (
+	spoolTmp      = "tmp"
+	spoolDeferred = "deferred"
+	spoolActive   = "active"
+	spoolFailed   = "failed"
+)
+
+// QueueItem is a message stored in the queue together with its delivery state.
+type QueueItem struct {
+	ID          string    `json:"id"`
+	Email       *Email    `json:"email"`
+	State       string    `json:"state"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+}
+
+// Queue is a persistent outbound queue stored in a spool directory.
+// Every message is a JSON file moved atomically between the subdirectories of
+// the spool following its state, so the queue survives the crashes of the process.
+type Queue struct {
+	// Dir is the spool directory.
+	Dir string
+	// Sender is used by the worker to send the messages.
+	Sender Sender
+	// Policy decides the delay between the attempts, MaxAttempts and
+	// MaxElapsedTime are ignored.
+	Policy RetryPolicy
+	// MaxAge is the time a message is kept in the queue before it expires.
+	MaxAge time.Duration
+	// PollInterval is the interval between two scans of the spool done by
+	// Run, if 0 DefaultPollInterval is used.
+	PollInterval time.Duration
+
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+// OpenQueue opens the queue stored in dir, creating the spool if needed.
+// The messages left active by a crash are deferred again.
+func OpenQueue(dir string, sender Sender) (*Queue, error) {
+	q := &Queue{Dir: dir, Sender: sender, Policy: DefaultRetryPolicy, MaxAge: 5 * 24 * time.Hour,
+		PollInterval: DefaultPollInterval, wake: make(chan struct{}, 1)}
+	for _, sub := range []string{spoolTmp, spoolDeferred, spoolActive, spoolFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	active, err := q.ids(spoolActive)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range active {
+		item, err := q.read(spoolActive, id)
+		if err != nil {
+			return nil, err
+		}
+		item.State = QueueStateDeferred
+		if err := q.move(item, spoolActive, spoolDeferred); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Enqueue stores the message in the queue and returns its queue ID.
+func (q *Queue) Enqueue(msg *Email) (string, error) {
+	now := time.Now()
+	item := &QueueItem{ID: nuid.Next(), Email: msg, State: QueueStateDeferred, Created: now, NextAttempt: now}
+	if q.MaxAge > 0 {
+		item.Expires = now.Add(q.MaxAge)
+	}
+	q.mu.Lock()
+	err := q.write(item, spoolDeferred)
+	q.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	q.notify()
+	return item.ID, nil
+}
+
+// List returns all the messages in the queue sorted by creation time.
+func (q *Queue) List() ([]*QueueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]*QueueItem, 0)
+	for _, sub := range []string{spoolDeferred, spoolActive, spoolFailed} {
+		ids, err := q.ids(sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			item, err := q.read(sub, id)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.Before(items[j].Created) })
+	return items, nil
+}
+
+// Inspect returns the message with the queue ID.
+func (q *Queue) Inspect(id string) (*QueueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, _, err := q.find(id)
+	return item, err
+}
+
+// RetryNow schedules the message with the queue ID for an immediate attempt.
+// A failed message is deferred again.
+func (q *Queue) RetryNow(id string) error {
+	q.mu.Lock()
+	item, sub, err := q.find(id)
+	if err == nil && sub == spoolActive {
+		err = errors.New("mandala: message is being sent")
+	}
+	if err == nil {
+		item.State = QueueStateDeferred
+		item.NextAttempt = time.Now()
+		if !item.Expires.IsZero() && item.Expires.Before(item.NextAttempt) && q.MaxAge > 0 {
+			item.Expires = item.NextAttempt.Add(q.MaxAge)
+		}
+		err = q.move(item, sub, spoolDeferred)
+	}
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Delete removes the message with the queue ID from the queue.
+func (q *Queue) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, sub, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	if sub == spoolActive {
+		return errors.New("mandala: message is being sent")
+	}
+	return os.Remove(q.path(sub, id))
+}
+
+// Run drains the queue until the context is done, sending the messages when
+// their next attempt is due.
+func (q *Queue) Run(ctx context.Context) error {
+	for {
+		if err := q.Process(); err != nil {
+			return err
+		}
+		interval := q.PollInterval
+		if interval <= 0 {
+			interval = DefaultPollInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-q.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Process sends once all the messages whose next attempt is due.
+// A message that fails with a transient error is deferred following the
+// retry policy, until it expires.
+func (q *Queue) Process() error {
+	q.mu.Lock()
+	ids, err := q.ids(spoolDeferred)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		item, err := q.claim(id)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			continue
+		}
+		if err := q.deliver(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim moves a due message to the active state. It returns nil if the
+// message is not due or has been removed.
+func (q *Queue) claim(id string) (*QueueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, err := q.read(spoolDeferred, id)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !item.Expires.IsZero() && now.After(item.Expires) {
+		item.State = QueueStateFailed
+		item.LastError = "message expired: " + item.LastError
+		return nil, q.move(item, spoolDeferred, spoolFailed)
+	}
+	if now.Before(item.NextAttempt) {
+		return nil, nil
+	}
+	item.State = QueueStateActive
+	if err := q.move(item, spoolDeferred, spoolActive); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// deliver sends an active message and stores the outcome.
+// It returns an error only if the outcome can not be stored.
+func (q *Queue) deliver(item *QueueItem) error {
+	err := q.Sender.Send(item.Email)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err == nil {
+		return os.Remove(q.path(spoolActive, item.ID))
+	}
+	var perr *PartialDeliveryError
+	if errors.As(err, &perr) {
+		// the next attempts send the message only to the recipients that can be retried
+		item.Email = item.Email.withRecipients(perr.Retry())
+	}
+	item.Attempts++
+	item.LastError = err.Error()
+	item.NextAttempt = time.Now().Add(q.Policy.Delay(item.Attempts))
+	if IsTransient(err) && (item.Expires.IsZero() || item.NextAttempt.Before(item.Expires)) {
+		item.State = QueueStateDeferred
+		return q.move(item, spoolActive, spoolDeferred)
+	}
+	item.State = QueueStateFailed
+	return q.move(item, spoolActive, spoolFailed)
+}
+
+// notify wakes up the worker.
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// find returns a message and the subdirectory where it is stored.
+func (q *Queue) find(id string) (*QueueItem, string, error) {
+	if strings.ContainsAny(id, `/\`) {
+		return nil, "", ErrNotQueued
+	}
+	for _, sub := range []string{spoolDeferred, spoolActive, spoolFailed} {
+		item, err := q.read(sub, id)
+		if os.IsNotExist(err) {
+			continue
+		}
+		return item, sub, err
+	}
+	return nil, "", ErrNotQueued
+}
+
+// move renames the message file from the source subdirectory to the
+// destination one and then rewrites it with the updated item, so the message
+// is never lost nor duplicated. If the process crashes before the rewrite,
+// the subdirectory is still authoritative for the state of the message.
+func (q *Queue) move(item *QueueItem, from, to string) error {
+	if from != to {
+		if err := os.Rename(q.path(from, item.ID), q.path(to, item.ID)); err != nil {
+			return err
+		}
+	}
+	return q.write(item, to)
+}
+
+// write stores the message atomically: it is written in the tmp subdirectory
+// and then renamed.
+func (q *Queue) write(item *QueueItem, sub string) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Join(q.Dir, spoolTmp), item.ID)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), q.path(sub, item.ID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// read loads a message from a subdirectory.
+func (q *Queue) read(sub, id string) (*QueueItem, error) {
+	data, err := os.ReadFile(q.path(sub, id))
+	if err != nil {
+		return nil, err
+	}
+	item := new(QueueItem)
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	// the subdirectory is the state, also if a move was interrupted
+	item.State = sub
+	return item, nil
+}
+
+// ids returns the IDs of the messages stored in a subdirectory.
+func (q *Queue) ids(sub string) ([]string, error) {
+	files, err := os.ReadDir(filepath.Join(q.Dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	return ids, nil
+}
+
+// path returns the path of the message file.
+func (q *Queue) path(sub, id string) string {
+	return filepath.Join(q.Dir, sub, id+".json")
+}
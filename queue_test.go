@@ -0,0 +1,179 @@
+package mandala
+
+import (
+	"errors"
+	"net/textproto"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// senderFunc adapts a function to the Sender interface.
+type senderFunc func(msg *Email) error
+
+func (f senderFunc) Send(msg *Email) error {
+	return f(msg)
+}
+
+func TestQueue_Process(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantState string // empty if the message must be removed
+	}{
+		{name: "sent", err: nil},
+		{name: "transient failure", err: &textproto.Error{Code: 451, Msg: "try later"}, wantState: QueueStateDeferred},
+		{name: "permanent failure", err: &textproto.Error{Code: 550, Msg: "no such user"}, wantState: QueueStateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			q, err := OpenQueue(t.TempDir(), senderFunc(func(msg *Email) error {
+				sent = append(sent, msg.Subject)
+				return tt.err
+			}))
+			if err != nil {
+				t.Fatalf("OpenQueue() error = %v", err)
+			}
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+			msg.AddAttachment("a.txt", "text/plain", []byte("attachment"))
+			id, err := q.Enqueue(msg)
+			if err != nil {
+				t.Fatalf("Queue.Enqueue() error = %v", err)
+			}
+			if err := q.Process(); err != nil {
+				t.Fatalf("Queue.Process() error = %v", err)
+			}
+			if len(sent) != 1 || sent[0] != "Hello" {
+				t.Errorf("Queue.Process() sent = %v", sent)
+			}
+			item, err := q.Inspect(id)
+			if tt.wantState == "" {
+				if err != ErrNotQueued {
+					t.Errorf("Queue.Inspect() error = %v, want %v", err, ErrNotQueued)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Queue.Inspect() error = %v", err)
+			}
+			if item.State != tt.wantState || item.Attempts != 1 || item.LastError == "" {
+				t.Errorf("Queue.Inspect() = %+v", item)
+			}
+			if string(item.Email.Attachments[0].Body) != "attachment" {
+				t.Errorf("Queue.Inspect() attachment = %q", item.Email.Attachments[0].Body)
+			}
+			// not due yet
+			q.Process()
+			if len(sent) != 1 {
+				t.Errorf("Queue.Process() sent a message not due")
+			}
+			if err := q.RetryNow(id); err != nil {
+				t.Errorf("Queue.RetryNow() error = %v", err)
+			}
+			q.Process()
+			if len(sent) != 2 {
+				t.Errorf("Queue.Process() did not retry the message")
+			}
+			if err := q.Delete(id); err != nil {
+				t.Errorf("Queue.Delete() error = %v", err)
+			}
+			if items, _ := q.List(); len(items) != 0 {
+				t.Errorf("Queue.List() = %v, want empty", items)
+			}
+		})
+	}
+}
+
+func TestQueue_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenQueue(dir, senderFunc(func(msg *Email) error { return errors.New("not used") }))
+	id, _ := q.Enqueue(NewEmail(EmailAddress{Address: "from@test.com"}, nil, "Hello", "", "Hello world!"))
+	// simulate a crash during the sending
+	if _, err := q.claim(id); err != nil {
+		t.Fatalf("Queue.claim() error = %v", err)
+	}
+	q, err := OpenQueue(dir, nil)
+	if err != nil {
+		t.Fatalf("OpenQueue() error = %v", err)
+	}
+	item, err := q.Inspect(id)
+	if err != nil || item.State != QueueStateDeferred {
+		t.Errorf("Queue.Inspect() = %v, %v", item, err)
+	}
+	if ids, _ := q.ids(spoolDeferred); len(ids) != 1 {
+		t.Errorf("OpenQueue() deferred = %v, want 1 message", ids)
+	}
+}
+
+func TestQueue_Expire(t *testing.T) {
+	q, _ := OpenQueue(t.TempDir(), senderFunc(func(msg *Email) error { return nil }))
+	q.MaxAge = time.Nanosecond
+	id, _ := q.Enqueue(NewEmail(EmailAddress{Address: "from@test.com"}, nil, "Hello", "", "Hello world!"))
+	time.Sleep(time.Millisecond)
+	q.Process()
+	if item, err := q.Inspect(id); err != nil || item.State != QueueStateFailed {
+		t.Errorf("Queue.Inspect() = %v, %v, want expired", item, err)
+	}
+}
+
+func TestQueue_InterruptedMove(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenQueue(dir, nil)
+	id, _ := q.Enqueue(NewEmail(EmailAddress{Address: "from@test.com"}, nil, "Hello", "", "Hello world!"))
+	// simulate a crash after the rename of a move to failed and before the rewrite
+	if err := os.Rename(q.path(spoolDeferred, id), q.path(spoolFailed, id)); err != nil {
+		t.Fatalf("os.Rename() error = %v", err)
+	}
+	q, err := OpenQueue(dir, nil)
+	if err != nil {
+		t.Fatalf("OpenQueue() error = %v", err)
+	}
+	items, err := q.List()
+	if err != nil || len(items) != 1 || items[0].State != QueueStateFailed {
+		t.Errorf("Queue.List() = %v, %v, want 1 failed message", items, err)
+	}
+}
+
+func TestQueue_Process_StoreError(t *testing.T) {
+	var q *Queue
+	q, _ = OpenQueue(t.TempDir(), senderFunc(func(msg *Email) error {
+		// the outcome can not be stored if the message file disappears
+		ids, _ := q.ids(spoolActive)
+		for _, id := range ids {
+			os.Remove(q.path(spoolActive, id))
+		}
+		return nil
+	}))
+	q.Enqueue(NewEmail(EmailAddress{Address: "from@test.com"}, nil, "Hello", "", "Hello world!"))
+	if err := q.Process(); err == nil {
+		t.Errorf("Queue.Process() error = nil, want the error storing the outcome")
+	}
+}
+
+func TestQueue_Process_PartialDelivery(t *testing.T) {
+	var sent [][]string
+	q, _ := OpenQueue(t.TempDir(), senderFunc(func(msg *Email) error {
+		sent = append(sent, msg.recipients())
+		if len(sent) > 1 {
+			return nil
+		}
+		return &PartialDeliveryError{Delivered: []string{"to1@test.com"}, Failed: []*RcptError{
+			{Recipient: "to2@test.com", Err: &SMTPError{Code: 452, Message: "mailbox full"}},
+			{Recipient: "to3@test.com", Err: &SMTPError{Code: 550, Message: "no such user"}},
+		}}
+	}))
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}, EmailAddress{Address: "to2@test.com"}, EmailAddress{Address: "to3@test.com"}}, "Hello", "", "Hello world!")
+	id, _ := q.Enqueue(msg)
+	q.Process()
+	item, err := q.Inspect(id)
+	if err != nil || item.State != QueueStateDeferred || !reflect.DeepEqual(item.Email.Recipients, []string{"to2@test.com"}) {
+		t.Fatalf("Queue.Inspect() = %+v, %v, want deferred to to2@test.com", item, err)
+	}
+	q.RetryNow(id)
+	q.Process()
+	if len(sent) != 2 || !reflect.DeepEqual(sent[1], []string{"to2@test.com"}) {
+		t.Errorf("Queue.Process() sent to %v, want the second attempt to to2@test.com only", sent)
+	}
+}
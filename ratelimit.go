@@ -0,0 +1,309 @@
+package mandala
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainLimit is the rate limit of the messages sent to a recipient domain.
+// A zero limit means unlimited.
+type DomainLimit struct {
+	// Pattern is the domain, as in "gmail.com", or a pattern in the syntax of
+	// path.Match, as in "*.outlook.com" or "*" for every domain.
+	Pattern   string
+	PerSecond int
+	PerMinute int
+	PerHour   int
+	// MaxConcurrent is the maximum number of concurrent sendings to the
+	// domain. It limits the connections only when every sending uses its own
+	// connection, as with MXDeliverer.
+	MaxConcurrent int
+}
+
+// RateLimiter throttles the sendings per recipient domain. The limits apply to
+// every matching domain separately: a sending over the limits is delayed until
+// it can be done. When the server replies 421 or 451 the domain is paused for
+// Backoff, doubled at every consecutive throttling reply, and its rates are
+// halved; they recover with the following successful sendings.
+// The state of a domain is kept only while it differs from the initial one.
+// A RateLimiter is safe for concurrent use by multiple goroutines.
+type RateLimiter struct {
+	// Limits are the limits of the domains, the first matching one applies.
+	// The sendings to a domain without limits are not throttled.
+	Limits []DomainLimit
+	// Backoff is the pause after a throttling reply, the default is 1 minute.
+	Backoff time.Duration
+	// MaxBackoff is the maximum pause, the default is 1 hour.
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	domains map[string]*domainState // domains with limits and a state
+	evicted time.Time               // last eviction of the idle domains
+}
+
+// NewRateLimiter returns a new RateLimiter with the limits.
+func NewRateLimiter(limits ...DomainLimit) *RateLimiter {
+	return &RateLimiter{Limits: limits, Backoff: time.Minute, MaxBackoff: time.Hour}
+}
+
+// domainState is the state of the limits of a domain.
+type domainState struct {
+	limit     DomainLimit
+	buckets   []*bucket
+	conns     int
+	slow      float64   // factor applied to the rates, halved by the throttling replies
+	throttled int       // consecutive throttling replies
+	paused    time.Time // no sending before this time
+	waiters   int       // calls of Wait using the state
+	changed   chan struct{}
+}
+
+// bucket is a token bucket refilled at limit tokens per window.
+type bucket struct {
+	limit  float64
+	window time.Duration
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the last refill, scaled by slow.
+func (b *bucket) refill(now time.Time, slow float64) {
+	b.tokens += b.limit * slow * float64(now.Sub(b.last)) / float64(b.window)
+	if b.tokens > b.limit {
+		b.tokens = b.limit
+	}
+	b.last = now
+}
+
+// delay returns the time needed to accrue a token.
+func (b *bucket) delay(slow float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(b.window) / (b.limit * slow))
+}
+
+// Wait blocks until a message to the domain can be sent or the context is done.
+// The returned function must be called with the outcome of the sending.
+func (l *RateLimiter) Wait(ctx context.Context, domain string) (func(err error), error) {
+	s := l.state(strings.ToLower(domain))
+	if s == nil {
+		return func(error) {}, nil
+	}
+	defer func() {
+		l.mu.Lock()
+		s.waiters--
+		l.mu.Unlock()
+	}()
+	for {
+		l.mu.Lock()
+		delay, ok := s.take(time.Now())
+		changed := s.changed
+		l.mu.Unlock()
+		if ok {
+			var once sync.Once
+			return func(err error) { once.Do(func() { l.done(s, err) }) }, nil
+		}
+		if err := waitSlot(ctx, delay, changed); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitSlot waits for the delay, if not zero, or for the changed channel to be closed.
+func waitSlot(ctx context.Context, delay time.Duration, changed <-chan struct{}) error {
+	var timer <-chan time.Time
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer:
+	case <-changed:
+	}
+	return nil
+}
+
+// state returns the state of the domain, nil if the domain has no limits.
+// The state is used by the caller until it decrements waiters.
+func (l *RateLimiter) state(domain string) *domainState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.evicted) > time.Minute {
+		l.evict(now)
+	}
+	s, ok := l.domains[domain]
+	if !ok {
+		for _, limit := range l.Limits {
+			if ok, _ := path.Match(strings.ToLower(limit.Pattern), domain); ok {
+				s = newDomainState(limit)
+				break
+			}
+		}
+		if s == nil {
+			return nil
+		}
+		if l.domains == nil {
+			l.domains = make(map[string]*domainState)
+		}
+		l.domains[domain] = s
+	}
+	s.waiters++
+	return s
+}
+
+// evict removes the states of the idle domains, equal to the initial ones.
+func (l *RateLimiter) evict(now time.Time) {
+	l.evicted = now
+	for domain, s := range l.domains {
+		if s.idle(now) {
+			delete(l.domains, domain)
+		}
+	}
+}
+
+func newDomainState(limit DomainLimit) *domainState {
+	s := &domainState{limit: limit, slow: 1, changed: make(chan struct{})}
+	now := time.Now()
+	windows := []struct {
+		limit  int
+		window time.Duration
+	}{{limit.PerSecond, time.Second}, {limit.PerMinute, time.Minute}, {limit.PerHour, time.Hour}}
+	for _, w := range windows {
+		if w.limit > 0 {
+			s.buckets = append(s.buckets, &bucket{limit: float64(w.limit), window: w.window, tokens: float64(w.limit), last: now})
+		}
+	}
+	return s
+}
+
+// idle reports whether the state is not in use and is equal to the initial one.
+func (s *domainState) idle(now time.Time) bool {
+	if s.waiters > 0 || s.conns > 0 || s.throttled > 0 || s.slow < 1 || now.Before(s.paused) {
+		return false
+	}
+	for _, b := range s.buckets {
+		b.refill(now, s.slow)
+		if b.tokens < b.limit {
+			return false
+		}
+	}
+	return true
+}
+
+// take takes a connection and a token of every bucket if they are all
+// available. Otherwise it returns the time to wait, 0 if it must wait for
+// a connection to be released.
+func (s *domainState) take(now time.Time) (time.Duration, bool) {
+	if now.Before(s.paused) {
+		return s.paused.Sub(now), false
+	}
+	if s.limit.MaxConcurrent > 0 && s.conns >= s.limit.MaxConcurrent {
+		return 0, false
+	}
+	var delay time.Duration
+	for _, b := range s.buckets {
+		b.refill(now, s.slow)
+		if d := b.delay(s.slow); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		return delay, false
+	}
+	for _, b := range s.buckets {
+		b.tokens--
+	}
+	s.conns++
+	return 0, true
+}
+
+// done releases the connection of a sending and adapts the rates to its outcome.
+func (l *RateLimiter) done(s *domainState, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.conns--
+	switch {
+	case isThrottling(err):
+		backoff := l.Backoff
+		if backoff <= 0 {
+			backoff = time.Minute
+		}
+		backoff <<= min(s.throttled, 16)
+		if l.MaxBackoff > 0 && backoff > l.MaxBackoff {
+			backoff = l.MaxBackoff
+		}
+		s.throttled++
+		s.paused = time.Now().Add(backoff)
+		s.slow = max(s.slow/2, 1.0/64)
+	case err == nil:
+		s.throttled = 0
+		s.slow = min(s.slow*1.1, 1)
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// isThrottling reports whether the error is a throttling reply of the server:
+// 421 service not available or 451 local error in processing.
+func isThrottling(err error) bool {
+	var terr *textproto.Error
+	return errors.As(err, &terr) && (terr.Code == 421 || terr.Code == 451)
+}
+
+// LimitedSender is a Sender that throttles the messages with a RateLimiter.
+// A message to recipients of many domains waits for all of them.
+type LimitedSender struct {
+	Sender  Sender
+	Limiter *RateLimiter
+}
+
+// Send waits for the limits of the recipient domains and sends the message.
+func (s *LimitedSender) Send(msg *Email) error {
+	return s.SendContext(context.Background(), msg)
+}
+
+// SendContext is like Send but it stops waiting when the context is done.
+func (s *LimitedSender) SendContext(ctx context.Context, msg *Email) error {
+	done, err := s.Limiter.waitAll(ctx, msg.recipients())
+	if err != nil {
+		return err
+	}
+	err = s.Sender.Send(msg)
+	done(err)
+	return err
+}
+
+// waitAll blocks until a message to the addresses can be sent, waiting for
+// the limits of all their domains. The returned function must be called with
+// the outcome of the sending.
+func (l *RateLimiter) waitAll(ctx context.Context, addrs []string) (func(err error), error) {
+	domains, _ := groupByDomain(addrs)
+	// the domains are taken in order to avoid deadlocks between the sendings
+	sort.Strings(domains)
+	dones := make([]func(error), 0, len(domains))
+	doneAll := func(err error) {
+		for _, done := range dones {
+			done(err)
+		}
+	}
+	for _, domain := range domains {
+		done, err := l.Wait(ctx, domain)
+		if err != nil {
+			doneAll(err)
+			return nil, err
+		}
+		dones = append(dones, done)
+	}
+	return doneAll, nil
+}
@@ -0,0 +1,167 @@
+package mandala
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	tests := []struct {
+		name        string
+		limits      []DomainLimit
+		domain      string
+		sendings    int
+		minDuration time.Duration
+	}{
+		{name: "no limits", domain: "test.com", sendings: 10},
+		{name: "other domain", limits: []DomainLimit{{Pattern: "gmail.com", PerSecond: 1}}, domain: "test.com", sendings: 10},
+		{name: "per second", limits: []DomainLimit{{Pattern: "test.com", PerSecond: 20}}, domain: "test.com", sendings: 23,
+			minDuration: 100 * time.Millisecond},
+		{name: "pattern", limits: []DomainLimit{{Pattern: "*.test.com", PerSecond: 20}}, domain: "MX.Test.com", sendings: 23,
+			minDuration: 100 * time.Millisecond},
+		{name: "first match", limits: []DomainLimit{{Pattern: "test.com"}, {Pattern: "*", PerSecond: 1}}, domain: "test.com", sendings: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(tt.limits...)
+			start := time.Now()
+			for i := 0; i < tt.sendings; i++ {
+				done, err := l.Wait(context.Background(), tt.domain)
+				if err != nil {
+					t.Fatalf("RateLimiter.Wait() error = %v", err)
+				}
+				done(nil)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tt.minDuration {
+				t.Errorf("RateLimiter.Wait() took %v, want at least %v", elapsed, tt.minDuration)
+			}
+			if tt.minDuration == 0 && elapsed > 100*time.Millisecond {
+				t.Errorf("RateLimiter.Wait() took %v, want no delay", elapsed)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_MaxConcurrent(t *testing.T) {
+	l := NewRateLimiter(DomainLimit{Pattern: "*", MaxConcurrent: 2})
+	var mu sync.Mutex
+	var conns, maxConns int
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := l.Wait(context.Background(), "test.com")
+			if err != nil {
+				t.Errorf("RateLimiter.Wait() error = %v", err)
+				return
+			}
+			mu.Lock()
+			conns++
+			maxConns = max(maxConns, conns)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			conns--
+			mu.Unlock()
+			done(nil)
+		}()
+	}
+	wg.Wait()
+	if maxConns != 2 {
+		t.Errorf("concurrent sendings = %d, want 2", maxConns)
+	}
+}
+
+func TestRateLimiter_Throttling(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantPause bool
+	}{
+		{name: "sent", err: nil},
+		{name: "rejected", err: &SMTPError{Command: "MAIL", Code: 550}},
+		{name: "service not available", err: &SMTPError{Command: "MAIL", Code: 421}, wantPause: true},
+		{name: "local error", err: &SMTPError{Command: "RCPT", Code: 451}, wantPause: true},
+		{name: "connection refused", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(DomainLimit{Pattern: "*", PerSecond: 100})
+			l.Backoff = 50 * time.Millisecond
+			done, err := l.Wait(context.Background(), "test.com")
+			if err != nil {
+				t.Fatalf("RateLimiter.Wait() error = %v", err)
+			}
+			done(tt.err)
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			done, err = l.Wait(ctx, "test.com")
+			if paused := err != nil; paused != tt.wantPause {
+				t.Fatalf("RateLimiter.Wait() error = %v, want paused %v", err, tt.wantPause)
+			}
+			if !tt.wantPause {
+				done(nil)
+				return
+			}
+			if _, err := l.Wait(context.Background(), "test.com"); err != nil {
+				t.Fatalf("RateLimiter.Wait() after the pause error = %v", err)
+			}
+			if slow := l.domains["test.com"].slow; slow != 0.5 {
+				t.Errorf("rate factor = %v, want 0.5", slow)
+			}
+		})
+	}
+}
+
+func TestLimitedSender_SendContext(t *testing.T) {
+	sent := 0
+	s := &LimitedSender{
+		Sender:  senderFunc(func(msg *Email) error { sent++; return nil }),
+		Limiter: NewRateLimiter(DomainLimit{Pattern: "test.com", MaxConcurrent: 1}),
+	}
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}, EmailAddress{Address: "to@example.com"}}, "Hello", "", "Hello world!")
+	if err := s.Send(msg); err != nil {
+		t.Fatalf("LimitedSender.Send() error = %v", err)
+	}
+	// the connection is busy until the context is done
+	done, _ := s.Limiter.Wait(context.Background(), "test.com")
+	defer done(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.SendContext(ctx, msg); err != context.DeadlineExceeded {
+		t.Errorf("LimitedSender.SendContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if sent != 1 {
+		t.Errorf("messages sent = %d, want 1", sent)
+	}
+}
+
+func TestRateLimiter_Evict(t *testing.T) {
+	l := NewRateLimiter(DomainLimit{Pattern: "*.test", PerSecond: 1000})
+	for _, domain := range []string{"a.test", "other.com"} {
+		done, err := l.Wait(context.Background(), domain)
+		if err != nil {
+			t.Fatalf("RateLimiter.Wait() error = %v", err)
+		}
+		done(nil)
+	}
+	if _, ok := l.domains["other.com"]; ok || len(l.domains) != 1 {
+		t.Errorf("RateLimiter domains = %v, want only a.test", l.domains)
+	}
+	// the bucket of a.test is full again after 1ms
+	time.Sleep(5 * time.Millisecond)
+	l.evicted = time.Time{}
+	done, _ := l.Wait(context.Background(), "b.test")
+	if _, ok := l.domains["a.test"]; ok {
+		t.Errorf("RateLimiter domains = %v, want a.test evicted", l.domains)
+	}
+	if _, ok := l.domains["b.test"]; !ok {
+		t.Errorf("RateLimiter domains = %v, want b.test in use", l.domains)
+	}
+	done(nil)
+}
@@ -0,0 +1,42 @@
+package mandala
+
+import "errors"
+
+// ErrRequireTLSNotSupported is returned when a message requires REQUIRETLS and the server does not support it.
+var ErrRequireTLSNotSupported = errors.New("smtp: server does not support REQUIRETLS")
+
+// RequireTLS is the TLS requirement of a message (RFC 8689).
+type RequireTLS string
+
+// TLS requirements of a message.
+const (
+	// RequireTLSDefault follows the TLS policy of the session.
+	RequireTLSDefault RequireTLS = ""
+	// RequireTLSYes sends the REQUIRETLS parameter on MAIL FROM: the message
+	// must travel over verified TLS connections on every hop. The sending fails
+	// if the server does not support REQUIRETLS or the session is not encrypted
+	// with a verified certificate.
+	RequireTLSYes RequireTLS = "yes"
+	// RequireTLSNo adds the "TLS-Required: No" header asking the next hops to
+	// deliver the message even when their TLS policy can not be met.
+	// TLSMandatory is not enforced on the transaction of the message and
+	// MXDeliverer falls back to TLSOpportunistic.
+	RequireTLSNo RequireTLS = "no"
+)
+
+// requireTLS checks that the session satisfies the TLS requirement of the message.
+func (c *Session) requireTLS(msg *Email) error {
+	switch msg.RequireTLS {
+	case RequireTLSNo:
+		return nil
+	case RequireTLSYes:
+		state, ok := c.TLSConnectionState()
+		if !ok || len(state.VerifiedChains) == 0 {
+			return ErrTLSNotAvailable
+		}
+		if ok, _ := c.Extension("REQUIRETLS"); !ok {
+			return ErrRequireTLSNotSupported
+		}
+	}
+	return c.checkTLS()
+}
@@ -0,0 +1,103 @@
+package mandala
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestSession_RequireTLS_Plaintext(t *testing.T) {
+	tests := []struct {
+		name       string
+		requireTLS RequireTLS
+		policy     TLSPolicy
+		wantErr    error
+		snippets   []string
+	}{
+		{name: "required", requireTLS: RequireTLSYes, wantErr: ErrTLSNotAvailable},
+		{name: "mandatory policy", requireTLS: RequireTLSDefault, policy: TLSMandatory, wantErr: ErrTLSNotAvailable},
+		{name: "not required", requireTLS: RequireTLSNo, policy: TLSMandatory,
+			snippets: []string{"MAIL FROM:<from@test.com>\r\n", "TLS-Required: No\r\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+			msg.RequireTLS = tt.requireTLS
+			c, cmds := newFakeSession(t, "220 hello", "250-fake.host", "250 REQUIRETLS", "250 ok", "250 ok", "354 go", "250 queued")
+			c.TLSPolicy = tt.policy
+			err := c.SendSingleMessage(msg)
+			if err != tt.wantErr {
+				t.Fatalf("Session.SendSingleMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			FindSnippets(t, cmds.String(), tt.snippets)
+		})
+	}
+}
+
+func TestSession_RequireTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		ehlo     string
+		wantErr  error
+		wantMail string
+	}{
+		{name: "supported", ehlo: "250-example.com\r\n250 REQUIRETLS", wantMail: "MAIL FROM:<from@test.com> REQUIRETLS"},
+		{name: "not supported", ehlo: "250 example.com", wantErr: ErrRequireTLSNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, config := newTLSListener(t)
+			defer l.Close()
+			received := make(chan string, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				text := textproto.NewConn(conn)
+				text.PrintfLine("220 hello")
+				text.ReadLine()
+				text.PrintfLine(tt.ehlo)
+				line, _ := text.ReadLine()
+				received <- line
+				text.PrintfLine("250 ok")
+				text.ReadLine()
+				text.PrintfLine("250 ok")
+				text.ReadLine()
+				text.PrintfLine("354 go")
+				text.ReadDotLines()
+				text.PrintfLine("250 queued")
+			}()
+			config.ServerName = "example.com"
+			c, err := NewSessionTLS(l.Addr().String(), nil, config)
+			if err != nil {
+				t.Fatalf("NewSessionTLS() error = %v", err)
+			}
+			defer c.Close()
+			msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+			msg.RequireTLS = RequireTLSYes
+			err = c.SendSingleMessage(msg)
+			if err != tt.wantErr {
+				t.Fatalf("Session.SendSingleMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantMail == "" {
+				return
+			}
+			if line := <-received; line != tt.wantMail {
+				t.Errorf("Session.SendSingleMessage() sent %q, want %q", line, tt.wantMail)
+			}
+		})
+	}
+}
+
+func TestEmail_Write_TLSRequired(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	var b strings.Builder
+	if err := msg.Write(&b); err != nil {
+		t.Fatalf("Email.Write() error = %v", err)
+	}
+	if strings.Contains(b.String(), "TLS-Required") {
+		t.Errorf("Email.Write() wrote the TLS-Required header without RequireTLSNo")
+	}
+}
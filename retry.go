@@ -0,0 +1,190 @@
+package mandala
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/smtp"
+	"time"
+)
+
+// RetryPolicy configures the exponential backoff used to retry the transient failures.
+type RetryPolicy struct {
+	MaxAttempts     int           // maximum number of attempts, 0 means unlimited
+	InitialInterval time.Duration // delay before the first retry
+	MaxInterval     time.Duration // maximum delay between two attempts, 0 means unlimited
+	Multiplier      float64       // factor applied to the delay after every attempt
+	Jitter          float64       // randomization factor of the delay, between 0 and 1
+	MaxElapsedTime  time.Duration // maximum time spent retrying, 0 means unlimited
+}
+
+// DefaultRetryPolicy is the policy used by NewRetrySender.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:     5,
+	InitialInterval: 5 * time.Second,
+	MaxInterval:     5 * time.Minute,
+	Multiplier:      2,
+	Jitter:          0.2,
+	MaxElapsedTime:  30 * time.Minute,
+}
+
+// Delay returns the delay before the attempt following the given one,
+// counting the attempts from 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialInterval) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxInterval > 0 && delay > float64(p.MaxInterval) {
+		delay = float64(p.MaxInterval)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Attempt records a sending attempt.
+type Attempt struct {
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+	Delay    time.Duration // delay before the next attempt, 0 if it is the last one
+}
+
+// RetryResult contains the attempts done to send a message.
+type RetryResult struct {
+	Attempts   []Attempt
+	Recipients []RcptResult // outcome of every RCPT TO command of the last attempt to every recipient
+}
+
+// RetrySender sends messages opening a new session for every attempt and
+// retrying when the failure is transient: 4xx replies and network errors.
+// Permanent failures are not retried, nor the failures after the end of the
+// message was sent without a reply, because the server may have accepted it.
+type RetrySender struct {
+	// Host is the address of the SMTP server, as in "mail.example.com:smtp".
+	Host string
+	// Auth is the authentication mechanism used to open the sessions.
+	Auth   smtp.Auth
+	Policy RetryPolicy
+	// Dial opens a new session ready to send messages. If nil the sender uses
+	// DialContext and StartSessionContext with Host and Auth.
+	Dial func(ctx context.Context) (*Session, error)
+}
+
+// NewRetrySender returns a new RetrySender for the SMTP server at host using DefaultRetryPolicy.
+func NewRetrySender(host string, a smtp.Auth) *RetrySender {
+	return &RetrySender{Host: host, Auth: a, Policy: DefaultRetryPolicy}
+}
+
+// Send sends the message retrying the transient failures.
+func (r *RetrySender) Send(msg *Email) (*RetryResult, error) {
+	return r.SendContext(context.Background(), msg)
+}
+
+// SendContext sends the message retrying the transient failures until the
+// context is done. After a *PartialDeliveryError only the recipients that
+// can be retried are sent the message again.
+func (r *RetrySender) SendContext(ctx context.Context, msg *Email) (*RetryResult, error) {
+	result := &RetryResult{}
+	start := time.Now()
+	var partial *PartialDeliveryError // outcome of the previous attempts, if partial
+	for n := 1; ; n++ {
+		attempt := Attempt{Start: time.Now()}
+		var rcpts []RcptResult
+		var uncertain bool
+		rcpts, uncertain, attempt.Err = r.attempt(ctx, msg)
+		attempt.Duration = time.Since(attempt.Start)
+		err := attempt.Err
+		if partial != nil {
+			result.Recipients = mergeResults(result.Recipients, rcpts)
+			err = partial.retried(err)
+		} else {
+			result.Recipients = rcpts
+		}
+		if errors.As(err, &partial) {
+			msg = msg.withRecipients(partial.Retry())
+		}
+		if err == nil || !IsTransient(err) || uncertain || ctx.Err() != nil ||
+			(r.Policy.MaxAttempts > 0 && n >= r.Policy.MaxAttempts) {
+			result.Attempts = append(result.Attempts, attempt)
+			return result, err
+		}
+		delay := r.Policy.Delay(n)
+		if r.Policy.MaxElapsedTime > 0 && time.Since(start)+delay > r.Policy.MaxElapsedTime {
+			result.Attempts = append(result.Attempts, attempt)
+			return result, err
+		}
+		attempt.Delay = delay
+		result.Attempts = append(result.Attempts, attempt)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt opens a session and sends the message. On failure it reports
+// whether the server may have accepted the message anyway.
+func (r *RetrySender) attempt(ctx context.Context, msg *Email) ([]RcptResult, bool, error) {
+	c, err := r.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.Close()
+	var results []RcptResult
+	var sent bool
+	err = c.runContext(ctx, func() error {
+		var err error
+		results, err = c.SendSingleMessageResults(msg)
+		if err != nil {
+			return err
+		}
+		sent = true
+		return c.Quit()
+	})
+	if sent {
+		// the server has accepted the message, a failure of QUIT must not cause a retry
+		return results, false, nil
+	}
+	return results, c.uncertain(err), err
+}
+
+// dial opens a new session.
+func (r *RetrySender) dial(ctx context.Context) (*Session, error) {
+	if r.Dial != nil {
+		return r.Dial(ctx)
+	}
+	c, err := DialContext(ctx, r.Host, r.Auth)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.StartSessionContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// mergeResults replaces the results of the recipients sent the message again
+// with the ones of the last attempt.
+func mergeResults(results, last []RcptResult) []RcptResult {
+	for _, r := range last {
+		i := 0
+		for i < len(results) && results[i].Address != r.Address {
+			i++
+		}
+		if i == len(results) {
+			results = append(results, r)
+		} else {
+			results[i] = r
+		}
+	}
+	return results
+}
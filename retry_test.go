@@ -0,0 +1,141 @@
+package mandala
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetrySender_Send(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name         string
+		replies      []string // reply to RCPT TO of every attempt
+		closed       bool     // the server closes the connection after accepting the message
+		lost         bool     // the connection is lost before the reply to the message
+		interrupted  bool     // the connection is lost while the message is sent
+		maxAttempts  int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{name: "sent at first attempt", replies: []string{"250 ok"}, maxAttempts: 3, wantAttempts: 1},
+		{name: "sent after transient failures", replies: []string{"451 try later", "421 busy", "250 ok"}, maxAttempts: 3, wantAttempts: 3},
+		{name: "permanent failure", replies: []string{"550 no such user", "250 ok"}, maxAttempts: 3, wantErr: true, wantAttempts: 1},
+		{name: "connection closed after the message", replies: []string{"250 ok", "250 ok"}, closed: true, maxAttempts: 3, wantAttempts: 1},
+		{name: "connection lost before the reply", replies: []string{"250 ok", "250 ok"}, lost: true, maxAttempts: 3, wantErr: true, wantAttempts: 1},
+		{name: "connection lost during the message", replies: []string{"250 ok", "250 ok"}, interrupted: true, maxAttempts: 3, wantAttempts: 2},
+		{name: "too many attempts", replies: []string{"451 try later", "451 try later", "250 ok"}, maxAttempts: 2, wantErr: true, wantAttempts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRetrySender("fake.host:25", nil)
+			r.Policy = RetryPolicy{MaxAttempts: tt.maxAttempts, InitialInterval: time.Millisecond, Multiplier: 2, Jitter: 0.5}
+			n := 0
+			r.Dial = func(ctx context.Context) (*Session, error) {
+				reply := tt.replies[n]
+				n++
+				server := []string{"220 hello", "250 fake.host", "250 ok", reply, "354 go", "250 queued", "221 bye"}
+				if tt.closed {
+					server = server[:len(server)-1]
+				}
+				if (tt.lost || tt.interrupted) && n == 1 {
+					server = server[:5]
+				}
+				c, cmds := newFakeSession(t, server...)
+				if tt.interrupted && n == 1 {
+					conn := faker{Reader: strings.NewReader(strings.Join(server, "\r\n") + "\r\n"), Writer: failWriter{cmds, "Hello world!"}}
+					c, _ = NewSessionUsingConnection(conn, "fake.host", nil)
+				}
+				return c, nil
+			}
+			result, err := r.Send(msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RetrySender.Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(result.Attempts) != tt.wantAttempts {
+				t.Errorf("RetrySender.Send() attempts = %v, want %v", len(result.Attempts), tt.wantAttempts)
+			}
+			for i, a := range result.Attempts {
+				if last := i == len(result.Attempts)-1; last != (a.Delay == 0) {
+					t.Errorf("Attempt %d delay = %v", i, a.Delay)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{InitialInterval: time.Second, MaxInterval: 5 * time.Second, Multiplier: 2}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := p.Delay(i + 1); got != w {
+			t.Errorf("RetryPolicy.Delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestRetrySender_Send_PartialDelivery(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to1@test.com"}, EmailAddress{Address: "to2@test.com"}, EmailAddress{Address: "to3@test.com"}}, "Hello", "", "Hello world!")
+	tests := []struct {
+		name         string
+		servers      [][]string // LMTP dialog of every attempt
+		wantErr      bool
+		wantAttempts int
+		wantRcpts    []string // recipients sent at every attempt
+		wantAccepted []bool
+	}{
+		{name: "failed recipient retried",
+			servers: [][]string{
+				{"220 hello", "250 fake.host", "250 ok", "250 ok", "250 ok", "250 ok", "354 go", "250 ok", "452 mailbox full", "250 ok", "221 bye"},
+				{"220 hello", "250 fake.host", "250 ok", "250 ok", "354 go", "250 ok", "221 bye"},
+			},
+			wantAttempts: 2, wantRcpts: []string{"to1@test.com to2@test.com to3@test.com", "to2@test.com"}, wantAccepted: []bool{true, true, true}},
+		{name: "permanent failure not retried",
+			servers: [][]string{
+				{"220 hello", "250 fake.host", "250 ok", "250 ok", "250 ok", "250 ok", "354 go", "250 ok", "452 mailbox full", "550 no such user", "221 bye"},
+				{"220 hello", "250 fake.host", "250 ok", "250 ok", "354 go", "250 ok", "221 bye"},
+			},
+			wantErr: true, wantAttempts: 2, wantRcpts: []string{"to1@test.com to2@test.com to3@test.com", "to2@test.com"}, wantAccepted: []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRetrySender("fake.host:25", nil)
+			r.Policy = RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+			var cmds []*bytes.Buffer
+			r.Dial = func(ctx context.Context) (*Session, error) {
+				c, buf := newFakeSession(t, tt.servers[len(cmds)]...)
+				c.LMTP = true
+				cmds = append(cmds, buf)
+				return c, nil
+			}
+			result, err := r.Send(msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RetrySender.Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(result.Attempts) != tt.wantAttempts {
+				t.Errorf("RetrySender.Send() attempts = %v, want %v", len(result.Attempts), tt.wantAttempts)
+			}
+			for i, buf := range cmds {
+				var rcpts []string
+				for _, line := range strings.Split(buf.String(), "\r\n") {
+					if strings.HasPrefix(line, "RCPT TO:<") {
+						rcpts = append(rcpts, strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">"))
+					}
+				}
+				if got := strings.Join(rcpts, " "); i >= len(tt.wantRcpts) || got != tt.wantRcpts[i] {
+					t.Errorf("attempt %d recipients = %q, want %q", i+1, got, tt.wantRcpts)
+				}
+			}
+			if len(result.Recipients) != len(tt.wantAccepted) {
+				t.Fatalf("RetryResult.Recipients = %+v", result.Recipients)
+			}
+			for i, r := range result.Recipients {
+				if r.Accepted() != tt.wantAccepted[i] {
+					t.Errorf("RcptResult %v = %+v, want accepted %v", r.Address, r, tt.wantAccepted[i])
+				}
+			}
+		})
+	}
+}
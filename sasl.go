@@ -0,0 +1,250 @@
+package mandala
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// statefulAuth is implemented by the mechanisms that keep a state during the
+// authentication: Session.Auth uses a new instance for every authentication,
+// so the same Auth can be shared by many sessions.
+type statefulAuth interface {
+	newAuth() smtp.Auth
+}
+
+// ErrNoAuthMechanism is returned when the server does not advertise any of the
+// supported authentication mechanisms.
+var ErrNoAuthMechanism = errors.New("smtp: no supported authentication mechanism")
+
+// CredentialsAuth is an Auth that picks the strongest mechanism advertised by
+// the server among SCRAM-SHA-256, CRAM-MD5, PLAIN and LOGIN.
+type CredentialsAuth struct {
+	Username string
+	Password string
+	// AllowUnencrypted allows the plaintext mechanisms (PLAIN and LOGIN) on
+	// connections without TLS to hosts other than localhost.
+	AllowUnencrypted bool
+
+	mech smtp.Auth // mechanism in use
+}
+
+// NewCredentialsAuth returns a new CredentialsAuth.
+func NewCredentialsAuth(username, password string) *CredentialsAuth {
+	return &CredentialsAuth{Username: username, Password: password}
+}
+
+func (a *CredentialsAuth) newAuth() smtp.Auth {
+	return &CredentialsAuth{Username: a.Username, Password: a.Password, AllowUnencrypted: a.AllowUnencrypted}
+}
+
+// Start selects the mechanism and starts the authentication.
+func (a *CredentialsAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	advertised := make(map[string]bool)
+	for _, mech := range server.Auth {
+		advertised[strings.ToUpper(mech)] = true
+	}
+	plaintext := a.AllowUnencrypted || server.TLS || isLocalhost(server.Name)
+	switch {
+	case advertised["SCRAM-SHA-256"]:
+		a.mech = ScramSHA256Auth(a.Username, a.Password)
+	case advertised["CRAM-MD5"]:
+		a.mech = smtp.CRAMMD5Auth(a.Username, a.Password)
+	case advertised["PLAIN"] && plaintext:
+		a.mech = &plainAuth{a.Username, a.Password, true}
+	case advertised["LOGIN"] && plaintext:
+		a.mech = &loginAuth{a.Username, a.Password, true}
+	case advertised["PLAIN"] || advertised["LOGIN"]:
+		return "", nil, errUnencrypted
+	default:
+		return "", nil, ErrNoAuthMechanism
+	}
+	return a.mech.Start(server)
+}
+
+// Next continues the authentication with the selected mechanism.
+func (a *CredentialsAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if a.mech == nil {
+		return nil, errors.New("smtp: authentication not started")
+	}
+	return a.mech.Next(fromServer, more)
+}
+
+type plainAuth struct {
+	username, password string
+	allowUnencrypted   bool
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !a.allowUnencrypted && !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errUnencrypted
+	}
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("smtp: unexpected server challenge")
+	}
+	return nil, nil
+}
+
+type loginAuth struct {
+	username, password string
+	allowUnencrypted   bool
+}
+
+// LoginAuth returns an Auth that implements the LOGIN authentication
+// mechanism. LoginAuth will only send the credentials if the connection is
+// using TLS or is connected to localhost.
+func LoginAuth(username, password string) smtp.Auth {
+	return &loginAuth{username: username, password: password}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !a.allowUnencrypted && !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errUnencrypted
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.Contains(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.Contains(prompt, "password"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("smtp: unexpected LOGIN challenge %q", fromServer)
+}
+
+type scramAuth struct {
+	username, password string
+	nonce              string // client nonce, random if empty
+	// authentication state
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool // whether the server signature has been verified
+}
+
+// ScramSHA256Auth returns an Auth that implements the SCRAM-SHA-256
+// authentication mechanism (RFC 7677) without channel binding.
+func ScramSHA256Auth(username, password string) smtp.Auth {
+	return &scramAuth{username: username, password: password}
+}
+
+func (a *scramAuth) newAuth() smtp.Auth {
+	return &scramAuth{username: a.username, password: a.password, nonce: a.nonce}
+}
+
+func (a *scramAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	nonce := a.nonce
+	if nonce == "" {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, err
+		}
+		nonce = base64.RawStdEncoding.EncodeToString(b)
+	}
+	a.clientFirstBare = "n=" + saslName(a.username) + ",r=" + nonce
+	a.serverSignature, a.verified = nil, false
+	return "SCRAM-SHA-256", []byte("n,," + a.clientFirstBare), nil
+}
+
+func (a *scramAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if a.serverSignature != nil {
+		// server-final-message: it can be sent as a challenge or with the
+		// final reply, which carries only a human readable text
+		if !more {
+			if !a.verified {
+				return nil, errors.New("smtp: SCRAM authentication ended without the server signature")
+			}
+			return nil, nil
+		}
+		if a.verified {
+			return nil, errors.New("smtp: unexpected SCRAM challenge after the server signature")
+		}
+		if !bytes.HasPrefix(fromServer, []byte("v=")) {
+			return nil, fmt.Errorf("smtp: SCRAM server error %q", fromServer)
+		}
+		v, err := base64.StdEncoding.DecodeString(string(fromServer[2:]))
+		if err != nil || !hmac.Equal(v, a.serverSignature) {
+			return nil, errors.New("smtp: SCRAM server signature mismatch")
+		}
+		a.verified = true
+		return []byte{}, nil
+	}
+	if !more {
+		return nil, errors.New("smtp: SCRAM authentication ended before the server proof")
+	}
+	// server-first-message
+	var nonce, salt string
+	var iter int
+	for _, attr := range strings.Split(string(fromServer), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iter, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	clientNonce := a.clientFirstBare[strings.Index(a.clientFirstBare, ",r=")+3:]
+	if !strings.HasPrefix(nonce, clientNonce) || len(nonce) == len(clientNonce) || iter <= 0 {
+		return nil, fmt.Errorf("smtp: invalid SCRAM challenge %q", fromServer)
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: invalid SCRAM salt %q", salt)
+	}
+	saltedPassword := pbkdf2SHA256([]byte(a.password), saltBytes, iter)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientFinal := "c=biws,r=" + nonce
+	authMessage := []byte(a.clientFirstBare + "," + string(fromServer) + "," + clientFinal)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	a.serverSignature = hmacSHA256(hmacSHA256(saltedPassword, []byte("Server Key")), authMessage)
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// hmacSHA256 returns the HMAC-SHA-256 of data.
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a key of the size of SHA-256 (RFC 8018, one block).
+func pbkdf2SHA256(password, salt []byte, iter int) []byte {
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	u := hmacSHA256(password, append(append([]byte{}, salt...), block[:]...))
+	key := append([]byte{}, u...)
+	for n := 1; n < iter; n++ {
+		u = hmacSHA256(password, u)
+		for i := range key {
+			key[i] ^= u[i]
+		}
+	}
+	return key
+}
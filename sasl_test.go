@@ -0,0 +1,90 @@
+package mandala
+
+import (
+	"encoding/base64"
+	"net/smtp"
+	"testing"
+)
+
+func TestScramSHA256Auth(t *testing.T) {
+	// test vector of RFC 7677 section 3
+	a := &scramAuth{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: "smtp.test.com"})
+	if err != nil || mech != "SCRAM-SHA-256" || string(resp) != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("scramAuth.Start() = %q, %q, %v", mech, resp, err)
+	}
+	resp, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if err != nil || string(resp) != want {
+		t.Fatalf("scramAuth.Next() = %q, %v, want %q", resp, err, want)
+	}
+	if _, err := a.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="), true); err != nil {
+		t.Errorf("scramAuth.Next() server signature error = %v", err)
+	}
+}
+
+func TestSession_Auth_Scram(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	serverFirst := "334 " + b64([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	tests := []struct {
+		name    string
+		server  []string
+		wantErr bool
+	}{
+		{name: "server signature verified", server: []string{serverFirst, "334 " + b64([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")), "235 ok"}},
+		{name: "wrong server signature", server: []string{serverFirst, "334 " + b64([]byte("v=AAAA")), "501 aborted", "221 bye"}, wantErr: true},
+		{name: "server signature skipped", server: []string{serverFirst, "235 ok", "501 aborted", "221 bye"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeSession(t, append([]string{"220 hello", "250-localhost", "250 AUTH SCRAM-SHA-256"}, tt.server...)...)
+			c.a = &scramAuth{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+			if err := c.Auth(); (err != nil) != tt.wantErr {
+				t.Errorf("Session.Auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCredentialsAuth_Start(t *testing.T) {
+	tests := []struct {
+		name             string
+		server           *smtp.ServerInfo
+		allowUnencrypted bool
+		wantMech         string
+		wantErr          bool
+	}{
+		{name: "SCRAM preferred", server: &smtp.ServerInfo{Name: "smtp.test.com", Auth: []string{"PLAIN", "LOGIN", "CRAM-MD5", "SCRAM-SHA-256"}}, wantMech: "SCRAM-SHA-256"},
+		{name: "CRAM-MD5", server: &smtp.ServerInfo{Name: "smtp.test.com", Auth: []string{"PLAIN", "CRAM-MD5"}}, wantMech: "CRAM-MD5"},
+		{name: "PLAIN with TLS", server: &smtp.ServerInfo{Name: "smtp.test.com", TLS: true, Auth: []string{"LOGIN", "PLAIN"}}, wantMech: "PLAIN"},
+		{name: "LOGIN with TLS", server: &smtp.ServerInfo{Name: "smtp.test.com", TLS: true, Auth: []string{"LOGIN"}}, wantMech: "LOGIN"},
+		{name: "PLAIN without TLS", server: &smtp.ServerInfo{Name: "smtp.test.com", Auth: []string{"PLAIN", "LOGIN"}}, wantErr: true},
+		{name: "PLAIN without TLS allowed", server: &smtp.ServerInfo{Name: "smtp.test.com", Auth: []string{"PLAIN"}}, allowUnencrypted: true, wantMech: "PLAIN"},
+		{name: "no mechanism", server: &smtp.ServerInfo{Name: "smtp.test.com", TLS: true, Auth: []string{"GSSAPI"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewCredentialsAuth("user", "pass")
+			a.AllowUnencrypted = tt.allowUnencrypted
+			mech, _, err := a.Start(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CredentialsAuth.Start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mech != tt.wantMech {
+				t.Errorf("CredentialsAuth.Start() mech = %v, want %v", mech, tt.wantMech)
+			}
+		})
+	}
+}
+
+func TestSession_Auth_Login(t *testing.T) {
+	c, cmds := newFakeSession(t, "220 hello", "250-localhost", "250 AUTH LOGIN", "334 VXNlcm5hbWU6", "334 UGFzc3dvcmQ6", "235 ok")
+	c.serverName = "localhost"
+	c.a = NewCredentialsAuth("user", "pass")
+	if err := c.Auth(); err != nil {
+		t.Errorf("Session.Auth() error = %v", err)
+	}
+	if got, want := cmds.String(), "EHLO localhost\r\nAUTH LOGIN\r\ndXNlcg==\r\ncGFzcw==\r\n"; got != want {
+		t.Errorf("Session.Auth() sent %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,325 @@
+package mandala
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tracer receives the transcript of a session: the lines sent to and received
+// from the server and the details of the TLS handshakes.
+// The AUTH payloads are redacted and the message bodies are truncated before
+// they are passed to the Tracer.
+type Tracer interface {
+	// Line is called for every line sent to the server (client is true) or
+	// received from it, without the trailing CRLF.
+	Line(client bool, line string)
+	// TLS is called when the connection is encrypted.
+	TLS(state tls.ConnectionState)
+}
+
+// SlogTracer is a Tracer writing the transcript to a slog.Logger.
+type SlogTracer struct {
+	Logger *slog.Logger
+	Level  slog.Level
+}
+
+// NewSlogTracer returns a Tracer writing the transcript to the logger at debug level.
+// If logger is nil slog.Default() is used.
+func NewSlogTracer(logger *slog.Logger) *SlogTracer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogTracer{Logger: logger, Level: slog.LevelDebug}
+}
+
+// Line logs a line of the transcript.
+func (t *SlogTracer) Line(client bool, line string) {
+	dir := "S"
+	if client {
+		dir = "C"
+	}
+	t.Logger.Log(context.Background(), t.Level, "smtp", slog.String("dir", dir), slog.String("line", line))
+}
+
+// TLS logs the details of the TLS handshake.
+func (t *SlogTracer) TLS(state tls.ConnectionState) {
+	attrs := []any{
+		slog.String("version", tls.VersionName(state.Version)),
+		slog.String("cipher", tls.CipherSuiteName(state.CipherSuite)),
+		slog.String("server_name", state.ServerName),
+		slog.Bool("verified", len(state.VerifiedChains) > 0),
+	}
+	if len(state.PeerCertificates) > 0 {
+		attrs = append(attrs, slog.String("peer", state.PeerCertificates[0].Subject.String()))
+	}
+	t.Logger.Log(context.Background(), t.Level, "smtp tls", attrs...)
+}
+
+// transcript follows the SMTP dialog of a session to redact and truncate the
+// lines passed to the Tracer.
+type transcript struct {
+	c       *Session
+	mu      sync.Mutex
+	wline   []byte   // partial line sent
+	rline   []byte   // partial line received
+	pending []string // commands waiting for a reply
+	auth    bool     // AUTH exchange in progress
+	data    bool     // DATA message body in progress
+	chunk   int64    // bytes left in the BDAT chunk
+	body    []byte   // traced part of the message body
+	size    int64    // size of the message body
+	wrote   bool     // whether a command has been sent
+	started bool     // whether the Tracer has been called
+	greet   []string // lines received before the Tracer was set
+}
+
+// newText returns the textproto.Conn of the connection of the session,
+// passing the dialog to the transcript if the connection is traced.
+func (c *Session) newText() *textproto.Conn {
+	if c.trace == nil {
+		return textproto.NewConn(c.conn)
+	}
+	return textproto.NewConn(newTraceConn(c.conn, c.trace))
+}
+
+// startTrace starts tracing the connection when the Tracer has been set after
+// the session was created. It must be called before a command is sent: the
+// textproto.Conn is replaced and the bytes it has buffered are read again
+// through the transcript.
+func (c *Session) startTrace() {
+	if c.Tracer == nil || c.trace != nil {
+		return
+	}
+	buffered, _ := c.Text.R.Peek(c.Text.R.Buffered())
+	c.trace = &transcript{c: c, greet: c.greet}
+	c.greet = nil
+	tc := newTraceConn(c.conn, c.trace)
+	tc.r = bufio.NewReader(io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), c.conn))
+	c.Text = textproto.NewConn(tc)
+}
+
+// replyLines returns the lines of a reply read by textproto.
+func replyLines(code int, msg string) []string {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		lines[i] = strconv.Itoa(code) + sep + line
+	}
+	return lines
+}
+
+// traceConn is a connection that passes the SMTP dialog to the transcript.
+// The reads return at most one line, so the replies are traced when they are
+// consumed and not when they are buffered.
+type traceConn struct {
+	net.Conn
+	t *transcript
+	r *bufio.Reader
+}
+
+func newTraceConn(conn net.Conn, t *transcript) *traceConn {
+	return &traceConn{Conn: conn, t: t, r: bufio.NewReader(conn)}
+}
+
+func (tc *traceConn) Read(p []byte) (int, error) {
+	if tc.r.Buffered() == 0 {
+		if _, err := tc.r.Peek(1); err != nil {
+			return 0, err
+		}
+	}
+	buf, _ := tc.r.Peek(tc.r.Buffered())
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		buf = buf[:i+1]
+	}
+	n := copy(p, buf)
+	tc.r.Discard(n)
+	tc.t.received(p[:n])
+	return n, nil
+}
+
+func (tc *traceConn) Write(p []byte) (int, error) {
+	n, err := tc.Conn.Write(p)
+	tc.t.sent(p[:n])
+	return n, err
+}
+
+// sent follows the bytes sent to the server.
+func (t *transcript) sent(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.wrote = true
+	for len(p) > 0 {
+		if t.chunk > 0 {
+			n := int64(len(p))
+			if n > t.chunk {
+				n = t.chunk
+			}
+			t.bodyBytes(p[:n])
+			t.chunk -= n
+			p = p[n:]
+			if t.chunk == 0 {
+				t.flushBody()
+			}
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			t.wline = append(t.wline, p...)
+			return
+		}
+		line := append(t.wline, p[:i+1]...)
+		t.wline = nil
+		p = p[i+1:]
+		t.command(line)
+	}
+}
+
+// command traces a line sent to the server.
+func (t *transcript) command(line []byte) {
+	if t.data {
+		if string(line) == ".\r\n" {
+			t.data = false
+			t.flushBody()
+			t.pending = append(t.pending, "END-OF-DATA")
+			t.emit(true, ".")
+			return
+		}
+		t.bodyBytes(line)
+		return
+	}
+	text := strings.TrimRight(string(line), "\r\n")
+	if t.auth {
+		t.pending = append(t.pending, "AUTH")
+		t.emit(true, "[redacted]")
+		return
+	}
+	verb := commandName(text)
+	t.pending = append(t.pending, verb)
+	switch verb {
+	case "AUTH":
+		t.auth = true
+		if fields := strings.Fields(text); len(fields) > 2 {
+			text = fields[0] + " " + fields[1] + " [redacted]"
+		}
+	case "DATA":
+		t.data = true
+		t.size = 0
+	case "BDAT":
+		if fields := strings.Fields(text); len(fields) > 1 {
+			t.chunk, _ = strconv.ParseInt(fields[1], 10, 64)
+			t.size = 0
+		}
+	}
+	t.emit(true, text)
+}
+
+// received follows the bytes received from the server.
+func (t *transcript) received(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rline = append(t.rline, p...)
+	if !bytes.HasSuffix(t.rline, []byte("\n")) {
+		return
+	}
+	line := strings.TrimRight(string(t.rline), "\r\n")
+	t.rline = nil
+	t.emit(false, line)
+	if len(line) > 3 && line[3] == '-' {
+		// continuation of a multiline reply
+		return
+	}
+	if len(t.pending) == 0 {
+		return
+	}
+	verb := t.pending[0]
+	t.pending = t.pending[1:]
+	code, _ := strconv.Atoi(line[:min(3, len(line))])
+	switch {
+	case verb == "AUTH" && code != 334:
+		t.auth = false
+	case verb == "DATA" && code != 354:
+		t.data = false
+	}
+}
+
+// bodyBytes traces a piece of the message body up to the limit of the session.
+func (t *transcript) bodyBytes(p []byte) {
+	if room := t.c.TraceBodyLimit - len(t.body); room > 0 && t.c.Tracer != nil {
+		t.body = append(t.body, p[:min(room, len(p))]...)
+	}
+	t.size += int64(len(p))
+}
+
+// flushBody emits the traced part of the message body and the size of the elided part.
+func (t *transcript) flushBody() {
+	if len(t.body) > 0 {
+		for _, line := range strings.SplitAfter(string(t.body), "\n") {
+			if line != "" {
+				t.emit(true, strings.TrimRight(line, "\r\n"))
+			}
+		}
+	}
+	if elided := t.size - int64(len(t.body)); elided > 0 {
+		t.emit(true, fmt.Sprintf("[%d bytes of message body elided]", elided))
+	}
+	t.body = nil
+	t.size = 0
+}
+
+// emit passes the line to the Tracer. The lines received before the first
+// command are kept until the Tracer is set, so the greeting is traced too.
+func (t *transcript) emit(client bool, line string) {
+	tr := t.c.Tracer
+	if tr == nil {
+		if !client && !t.wrote {
+			t.greet = append(t.greet, line)
+		}
+		return
+	}
+	t.start(tr)
+	tr.Line(client, line)
+}
+
+// start passes to the Tracer the greeting and the TLS state of a connection
+// encrypted before the Tracer was set.
+func (t *transcript) start(tr Tracer) {
+	if t.started {
+		return
+	}
+	t.started = true
+	if state, ok := t.c.TLSConnectionState(); ok {
+		tr.TLS(state)
+	}
+	for _, line := range t.greet {
+		tr.Line(false, line)
+	}
+	t.greet = nil
+}
+
+// handshake passes the TLS state to the Tracer after STARTTLS.
+func (t *transcript) handshake(state tls.ConnectionState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr := t.c.Tracer
+	if tr == nil {
+		return
+	}
+	if t.started {
+		tr.TLS(state)
+		return
+	}
+	t.start(tr)
+}
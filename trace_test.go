@@ -0,0 +1,121 @@
+package mandala
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+type recordTracer struct {
+	lines []string
+	tls   int
+}
+
+func (r *recordTracer) Line(client bool, line string) {
+	if client {
+		r.lines = append(r.lines, "C: "+line)
+	} else {
+		r.lines = append(r.lines, "S: "+line)
+	}
+}
+
+func (r *recordTracer) TLS(state tls.ConnectionState) { r.tls++ }
+
+func TestSession_Tracer(t *testing.T) {
+	msg := NewEmail(EmailAddress{Address: "from@test.com"}, []EmailAddress{EmailAddress{Address: "to@test.com"}}, "Hello", "Hello world!", "")
+	tests := []struct {
+		name      string
+		server    []string
+		limit     int
+		snippets  []string
+		forbidden []string
+	}{
+		{name: "auth redacted", server: []string{"220 hello", "250-fake.host", "250 AUTH LOGIN", "334 VXNlcm5hbWU6", "334 UGFzc3dvcmQ6", "235 ok", "250 ok", "250 ok", "354 go", "250 queued"},
+			snippets:  []string{"S: 220 hello\n", "C: AUTH LOGIN\nS: 334 VXNlcm5hbWU6\nC: [redacted]\nS: 334 UGFzc3dvcmQ6\nC: [redacted]\nS: 235 ok\nC: MAIL FROM:<from@test.com>\n"},
+			forbidden: []string{"dXNlcg==", "c2VjcmV0"}},
+		{name: "body elided", server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "354 go", "250 queued"},
+			snippets:  []string{"C: DATA\nS: 354 go\nC: [", " bytes of message body elided]\nC: .\nS: 250 queued\n"},
+			forbidden: []string{"Subject"}},
+		{name: "body truncated", server: []string{"220 hello", "250 fake.host", "250 ok", "250 ok", "354 go", "250 queued"}, limit: 1000,
+			snippets: []string{"C: Subject: Hello\n", "C: Hello world!\n", "C: .\nS: 250 queued\n"}},
+		{name: "bdat elided", server: []string{"220 hello", "250-fake.host", "250 CHUNKING", "250 ok", "250 ok", "250 queued"},
+			snippets: []string{"C: BDAT ", " LAST\nC: [", " bytes of message body elided]\nS: 250 queued\n"}},
+		{name: "pipelined", server: []string{"220 hello", "250-fake.host", "250 PIPELINING", "250 ok", "250 ok", "354 go", "250 queued"},
+			snippets: []string{"C: MAIL FROM:<from@test.com>\nC: RCPT TO:<to@test.com>\nC: DATA\nS: 250 ok\nS: 250 ok\nS: 354 go\nC: [", "C: .\nS: 250 queued\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := faker{Reader: strings.NewReader(strings.Join(tt.server, "\r\n") + "\r\n"), Writer: &bytes.Buffer{}}
+			c, err := NewSessionUsingConnection(conn, "localhost", LoginAuth("user", "secret"))
+			if err != nil {
+				t.Fatalf("NewSessionUsingConnection() error = %v", err)
+			}
+			tracer := &recordTracer{}
+			c.Tracer = tracer
+			c.TraceBodyLimit = tt.limit
+			if err := c.StartSession(); err != nil {
+				t.Fatalf("Session.StartSession() error = %v", err)
+			}
+			if err := c.SendSingleMessage(msg); err != nil {
+				t.Fatalf("Session.SendSingleMessage() error = %v", err)
+			}
+			transcript := strings.Join(tracer.lines, "\n") + "\n"
+			FindSnippets(t, transcript, tt.snippets)
+			for _, s := range tt.forbidden {
+				if strings.Contains(transcript, s) {
+					t.Errorf("transcript contains %q:\n%s", s, transcript)
+				}
+			}
+		})
+	}
+}
+
+func TestSession_Tracer_TLS(t *testing.T) {
+	l, config := newTLSListener(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 hello")
+		text.ReadLine()
+		text.PrintfLine("250 example.com")
+		text.ReadLine()
+		text.PrintfLine("221 bye")
+	}()
+	c, err := NewSessionTLS(l.Addr().String(), nil, config)
+	if err != nil {
+		t.Fatalf("NewSessionTLS() error = %v", err)
+	}
+	defer c.Close()
+	tracer := &recordTracer{}
+	c.Tracer = tracer
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Session.Quit() error = %v", err)
+	}
+	if tracer.tls != 1 {
+		t.Errorf("Tracer.TLS() called %d times, want 1", tracer.tls)
+	}
+	FindSnippets(t, strings.Join(tracer.lines, "\n"), []string{"S: 220 hello\nC: EHLO localhost\nS: 250 example.com\nC: QUIT\nS: 221 bye"})
+}
+
+func TestSession_Tracer_NotSet(t *testing.T) {
+	c, _ := newFakeSession(t, "220 hello", "250 fake.host", "250 ok", "250 ok")
+	if err := c.Noop(); err != nil {
+		t.Fatalf("Session.Noop() error = %v", err)
+	}
+	if c.trace != nil {
+		t.Errorf("Session.trace = %v, want nil without a Tracer", c.trace)
+	}
+	tracer := &recordTracer{}
+	c.Tracer = tracer
+	if err := c.Noop(); err != nil {
+		t.Fatalf("Session.Noop() error = %v", err)
+	}
+	FindSnippets(t, strings.Join(tracer.lines, "\n"), []string{"S: 220 hello\nC: NOOP\nS: 250 ok"})
+}